@@ -0,0 +1,122 @@
+package mackerel
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// apiClient is a mackerelClient that calls Mackerel API.
+// Its methods return *APIError if the API call failed.
+type apiClient struct {
+	c *mackerel.Client
+}
+
+var _ mackerelClient = &apiClient{}
+
+// with returns a shallow copy of c.c that sends requests with ctx.
+func (c *apiClient) with(ctx context.Context) *mackerel.Client {
+	p := *c.c
+	h := http.Client{}
+	if c.c.HTTPClient != nil {
+		h = *c.c.HTTPClient
+	}
+	h.Transport = &contextTransport{ctx: ctx, base: h.Transport}
+	p.HTTPClient = &h
+	return &p
+}
+
+// contextTransport is a http.RoundTripper that binds requests to ctx.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req.WithContext(t.ctx))
+}
+
+func (c *apiClient) FindServices(ctx context.Context) ([]*mackerel.Service, error) {
+	a, err := c.with(ctx).FindServices()
+	return a, wrapAPIError(err, "GET /api/v0/services", "", "")
+}
+
+func (c *apiClient) CreateService(ctx context.Context, param *mackerel.CreateServiceParam) (*mackerel.Service, error) {
+	s, err := c.with(ctx).CreateService(param)
+	return s, wrapAPIError(err, "POST /api/v0/services", "", param.Name)
+}
+
+func (c *apiClient) FindRoles(ctx context.Context, serviceName string) ([]*mackerel.Role, error) {
+	a, err := c.with(ctx).FindRoles(serviceName)
+	return a, wrapAPIError(err, "GET /api/v0/services/<service>/roles", "", serviceName)
+}
+
+func (c *apiClient) CreateRole(ctx context.Context, serviceName string, param *mackerel.CreateRoleParam) (*mackerel.Role, error) {
+	r, err := c.with(ctx).CreateRole(serviceName, param)
+	return r, wrapAPIError(err, "POST /api/v0/services/<service>/roles", "", serviceName)
+}
+
+func (c *apiClient) FindHosts(ctx context.Context, param *mackerel.FindHostsParam) ([]*mackerel.Host, error) {
+	a, err := c.with(ctx).FindHosts(param)
+	return a, wrapAPIError(err, "GET /api/v0/hosts", "", param.Service)
+}
+
+func (c *apiClient) CreateHost(ctx context.Context, param *mackerel.CreateHostParam) (string, error) {
+	id, err := c.with(ctx).CreateHost(param)
+	return id, wrapAPIError(err, "POST /api/v0/hosts", "", "")
+}
+
+func (c *apiClient) UpdateHost(ctx context.Context, hostID string, param *mackerel.UpdateHostParam) (string, error) {
+	id, err := c.with(ctx).UpdateHost(hostID, param)
+	return id, wrapAPIError(err, "PUT /api/v0/hosts/<hostId>", hostID, "")
+}
+
+func (c *apiClient) RetireHost(ctx context.Context, hostID string) error {
+	err := c.with(ctx).RetireHost(hostID)
+	return wrapAPIError(err, "POST /api/v0/hosts/<hostId>/retire", hostID, "")
+}
+
+func (c *apiClient) UpdateHostStatus(ctx context.Context, hostID, status string) error {
+	err := c.with(ctx).UpdateHostStatus(hostID, status)
+	return wrapAPIError(err, "POST /api/v0/hosts/<hostId>/status", hostID, "")
+}
+
+func (c *apiClient) UpdateHostRoleFullnames(ctx context.Context, hostID string, roleFullnames []string) error {
+	err := c.with(ctx).UpdateHostRoleFullnames(hostID, roleFullnames)
+	return wrapAPIError(err, "PUT /api/v0/hosts/<hostId>/role-fullnames", hostID, "")
+}
+
+func (c *apiClient) PutServiceMetaData(ctx context.Context, serviceName, namespace string, v interface{}) error {
+	err := c.with(ctx).PutServiceMetaData(serviceName, namespace, v)
+	return wrapAPIError(err, "PUT /api/v0/services/<service>/metadata/<namespace>", "", serviceName)
+}
+
+func (c *apiClient) PutRoleMetaData(ctx context.Context, serviceName, roleName, namespace string, v interface{}) error {
+	err := c.with(ctx).PutRoleMetaData(serviceName, roleName, namespace, v)
+	return wrapAPIError(err, "PUT /api/v0/services/<service>/roles/<role>/metadata/<namespace>", "", serviceName)
+}
+
+func (c *apiClient) PutHostMetaData(ctx context.Context, hostID, namespace string, v interface{}) error {
+	err := c.with(ctx).PutHostMetaData(hostID, namespace, v)
+	return wrapAPIError(err, "PUT /api/v0/hosts/<hostId>/metadata/<namespace>", hostID, "")
+}
+
+func (c *apiClient) CreateGraphDefs(ctx context.Context, defs []*mackerel.GraphDefsParam) error {
+	err := c.with(ctx).CreateGraphDefs(defs)
+	return wrapAPIError(err, "POST /api/v0/graph-defs/create", "", "")
+}
+
+func (c *apiClient) PostHostMetricValues(ctx context.Context, metrics []*mackerel.HostMetricValue) error {
+	err := c.with(ctx).PostHostMetricValues(metrics)
+	return wrapAPIError(err, "POST /api/v0/tsdb", "", "")
+}
+
+func (c *apiClient) PostServiceMetricValues(ctx context.Context, name string, metrics []*mackerel.MetricValue) error {
+	err := c.with(ctx).PostServiceMetricValues(name, metrics)
+	return wrapAPIError(err, "POST /api/v0/services/<service>/tsdb", "", name)
+}
@@ -0,0 +1,43 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func TestAPIClientCancel(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mackerel.NewClient("dummy")
+	p.BaseURL = u
+	c := &apiClient{c: p}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	err = c.PostHostMetricValues(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PostHostMetricValues() = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Errorf("PostHostMetricValues() took %v; want to be canceled immediately", d)
+	}
+}
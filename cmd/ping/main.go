@@ -96,7 +96,13 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer pusher.Stop()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := pusher.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
 
 	http.HandleFunc("/", indexHandler)
 	if handler != nil {
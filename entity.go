@@ -1,109 +1,541 @@
 package mackerel
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/mackerelio-labs/mackerelexporter-go/internal/tag"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/metricname"
 	"github.com/mackerelio/mackerel-client-go"
 )
 
-func (e *Exporter) registerService(name string) error {
-	if _, ok := e.serviceRoles[name]; ok {
-		return nil
+// hostEntry is the state of the host that the exporter has registered.
+type hostEntry struct {
+	id          string // Mackerel's host ID
+	lastSeen    time.Time
+	created     bool                   // whether the exporter created the host
+	labelStatus string                 // the last host.status attribute that the exporter reflected
+	roles       []string               // sorted roleFullnames that the exporter set
+	roleSeen    map[string]time.Time   // the last time that each roleFullname is reported
+	metadata    map[string]interface{} // the last metadata that the exporter put
+}
+
+// entityKey returns the key to serialize API calls for an entity.
+func entityKey(kind, name string) string {
+	return kind + ":" + name
+}
+
+// lockEntity blocks until no other goroutine holds key, then holds it.
+// It serializes API calls for the same entity without holding e.entityMu across them,
+// and the caller should check the state again after it because others might have done the same work.
+func (e *Exporter) lockEntity(ctx context.Context, key string) (unlock func(), err error) {
+	for {
+		e.entityMu.Lock()
+		c, ok := e.inflight[key]
+		if !ok {
+			c = make(chan struct{})
+			e.inflight[key] = c
+			e.entityMu.Unlock()
+			return func() {
+				e.entityMu.Lock()
+				delete(e.inflight, key)
+				e.entityMu.Unlock()
+				close(c)
+			}, nil
+		}
+		e.entityMu.Unlock()
+		select {
+		case <-c:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lookupHost returns a copy of the state of the host.
+func (e *Exporter) lookupHost(customIdentifier string) (hostEntry, bool) {
+	e.entityMu.Lock()
+	defer e.entityMu.Unlock()
+	h, ok := e.hosts[customIdentifier]
+	if !ok {
+		return hostEntry{}, false
+	}
+	return *h, true
+}
+
+// updateHost calls f with the state of the host if it is registered.
+func (e *Exporter) updateHost(customIdentifier string, f func(h *hostEntry)) {
+	e.entityMu.Lock()
+	defer e.entityMu.Unlock()
+	if h, ok := e.hosts[customIdentifier]; ok {
+		f(h)
+	}
+}
+
+// touchHost updates the last seen time of the host, and returns its host ID if it is registered.
+func (e *Exporter) touchHost(customIdentifier string) (string, bool) {
+	var hostID string
+	ok := false
+	e.updateHost(customIdentifier, func(h *hostEntry) {
+		h.lastSeen = time.Now()
+		hostID, ok = h.id, true
+	})
+	return hostID, ok
+}
+
+// registerHost returns Mackerel's host ID for the entity of reg.
+// If the host is not registered yet, registerHost creates or updates the host with reg.
+func (e *Exporter) registerHost(ctx context.Context, reg *registration) (string, error) {
+	ent := &reg.entity
+	id := ent.CustomIdentifier
+	if hostID, ok := e.touchHost(id); ok {
+		return hostID, nil
 	}
-	a, err := e.c.FindServices()
+	unlock, err := e.lockEntity(ctx, entityKey("host", id))
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if hostID, ok := e.touchHost(id); ok {
+		return hostID, nil
+	}
+	hostID, created, err := e.upsertHost(ctx, reg)
+	if err != nil {
+		return "", err
+	}
+	h := &hostEntry{
+		id:       hostID,
+		lastSeen: time.Now(),
+		created:  created,
+	}
+	if s := ent.RoleFullname(); s != "" {
+		h.roles = []string{s}
+		h.roleSeen = map[string]time.Time{s: h.lastSeen}
+	}
+	e.entityMu.Lock()
+	e.hosts[id] = h
+	e.entityMu.Unlock()
+	return hostID, nil
+}
+
+// roleTTLPeriods is the number of export periods that the host keeps the role that is not reported.
+// Delta exports skip instruments that are not updated in the period,
+// so the roles from such instruments should not be removed immediately.
+const roleTTLPeriods = 10
+
+// syncHostRoles updates roles of the host if they differ from the last ones.
+// roles is the set of roleFullnames that are reported in an export,
+// and its values are labels of a record that have the role.
+// The host keeps the roles that were reported in the last roleTTLPeriods periods.
+func (e *Exporter) syncHostRoles(ctx context.Context, customIdentifier string, roles map[string]*label.Set) error {
+	unlock, err := e.lockEntity(ctx, entityKey("host", customIdentifier))
 	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	var (
+		hostID string
+		old    []string
+		a      []string
+		ok     bool
+	)
+	now := time.Now()
+	ttl := roleTTLPeriods * e.opts.Period
+	e.updateHost(customIdentifier, func(h *hostEntry) {
+		if h.roleSeen == nil {
+			h.roleSeen = make(map[string]time.Time)
+		}
+		for s := range roles {
+			h.roleSeen[s] = now
+		}
+		for s, t := range h.roleSeen {
+			if now.Sub(t) > ttl {
+				delete(h.roleSeen, s)
+				continue
+			}
+			a = append(a, s)
+		}
+		hostID, old, ok = h.id, h.roles, true
+	})
+	if !ok {
+		return nil
+	}
+	sort.Strings(a)
+	if reflect.DeepEqual(a, old) {
+		return nil
+	}
 	for _, s := range a {
-		if s.Name == name {
-			e.serviceRoles[name] = make(map[string]struct{})
-			return nil
+		labels, ok := roles[s]
+		if !ok {
+			continue // it has been registered when it was reported
+		}
+		i := strings.Index(s, ":")
+		if err := e.registerServiceRole(ctx, s[:i], s[i+1:], labels); err != nil {
+			return err
 		}
 	}
+	if err := e.c.UpdateHostRoleFullnames(ctx, hostID, a); err != nil {
+		return err
+	}
+	e.updateHost(customIdentifier, func(h *hostEntry) {
+		h.roles = a
+	})
+	return nil
+}
 
-	param := mackerel.CreateServiceParam{
-		Name: name,
+// hostMetaData returns labels that should be published as metadata of the host.
+func (e *Exporter) hostMetaData(labels *label.Set) map[string]interface{} {
+	if e.opts.HostMetaDataNamespace == "" || labels == nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	for iter := labels.Iter(); iter.Next(); {
+		kv := iter.Label()
+		for _, pattern := range e.opts.HostMetaDataPatterns {
+			if metricname.Match(string(kv.Key), pattern) {
+				m[string(kv.Key)] = kv.Value.AsInterface()
+				break
+			}
+		}
 	}
-	if _, err = e.c.CreateService(&param); err != nil {
+	return m
+}
+
+// syncHostMetaData merges m into the last metadata of the host, and puts it if it is changed.
+// Delta exports skip records that are not updated in the period,
+// so the keys that are not in m are kept.
+func (e *Exporter) syncHostMetaData(ctx context.Context, customIdentifier string, m map[string]interface{}) error {
+	unlock, err := e.lockEntity(ctx, entityKey("host", customIdentifier))
+	if err != nil {
 		return err
 	}
-	e.serviceRoles[name] = make(map[string]struct{})
+	defer unlock()
+	h, ok := e.lookupHost(customIdentifier)
+	if !ok {
+		return nil
+	}
+	merged := make(map[string]interface{}, len(h.metadata)+len(m))
+	for k, v := range h.metadata {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	m = merged
+	if reflect.DeepEqual(h.metadata, m) {
+		return nil
+	}
+	if err := e.c.PutHostMetaData(ctx, h.id, e.opts.HostMetaDataNamespace, m); err != nil {
+		return err
+	}
+	e.updateHost(customIdentifier, func(h *hostEntry) {
+		h.metadata = m
+	})
 	return nil
 }
 
-func (e *Exporter) registerServiceRole(s, role string) error {
-	if err := e.registerService(s); err != nil {
+// retireHosts retires hosts that have not reported since before.
+// If before is zero, retireHosts retires all hosts that the exporter has registered.
+func (e *Exporter) retireHosts(ctx context.Context, before time.Time) error {
+	e.entityMu.Lock()
+	ids := make([]string, 0, len(e.hosts))
+	for id := range e.hosts {
+		ids = append(ids, id)
+	}
+	e.entityMu.Unlock()
+
+	var errs ExportError
+	for _, id := range ids {
+		if err := e.retireHost(ctx, id, before); err != nil {
+			errs.add(&TargetError{Op: OpRetireHost, Host: id, Err: err})
+		}
+	}
+	return errs.err()
+}
+
+// retireHost retires the host if it has not reported since before.
+func (e *Exporter) retireHost(ctx context.Context, customIdentifier string, before time.Time) error {
+	unlock, err := e.lockEntity(ctx, entityKey("host", customIdentifier))
+	if err != nil {
 		return err
 	}
-	if _, ok := e.serviceRoles[s][role]; ok {
+	defer unlock()
+
+	// The host is removed before retiring it so that the records that are reported meanwhile
+	// wait for the retirement, and then register the host again.
+	e.entityMu.Lock()
+	h, ok := e.hosts[customIdentifier]
+	if !ok || (!before.IsZero() && !h.lastSeen.Before(before)) || (e.opts.RetireCreatedHostsOnly && !h.created) {
+		e.entityMu.Unlock()
 		return nil
 	}
-	a, err := e.c.FindRoles(s)
+	delete(e.hosts, customIdentifier)
+	e.entityMu.Unlock()
+
+	if err := e.c.RetireHost(ctx, h.id); err != nil {
+		e.entityMu.Lock()
+		e.hosts[customIdentifier] = h
+		e.entityMu.Unlock()
+		return err
+	}
+	e.entityMu.Lock()
+	e.hostCache.remove(customIdentifier)
+	e.entityMu.Unlock()
+	return nil
+}
+
+// hasServiceRole reports whether the service, or the role if it is not empty, is registered.
+func (e *Exporter) hasServiceRole(s, role string) bool {
+	e.entityMu.Lock()
+	defer e.entityMu.Unlock()
+	roles, ok := e.serviceRoles[s]
+	if !ok || role == "" {
+		return ok
+	}
+	_, ok = roles[role]
+	return ok
+}
+
+// registerService creates the service if it is not exist.
+// The memo of the service is made from labels.
+func (e *Exporter) registerService(ctx context.Context, name string, labels *label.Set) error {
+	if e.hasServiceRole(name, "") {
+		return nil
+	}
+	unlock, err := e.lockEntity(ctx, entityKey("service", name))
 	if err != nil {
 		return err
 	}
-	for _, r := range a {
-		if r.Name == role {
-			e.serviceRoles[s][role] = struct{}{}
-			return nil
+	defer unlock()
+	if e.hasServiceRole(name, "") {
+		return nil
+	}
+	a, err := e.c.FindServices(ctx)
+	if err != nil {
+		return err
+	}
+	if !containsService(a, name) {
+		param := mackerel.CreateServiceParam{
+			Name: name,
+			Memo: memo(e.opts.ServiceMemoKeys, labels),
+		}
+		if _, err = e.c.CreateService(ctx, &param); err != nil {
+			return err
 		}
 	}
+	e.entityMu.Lock()
+	e.serviceRoles[name] = make(map[string]struct{})
+	e.entityMu.Unlock()
+	e.putMetaData(ctx, name, "")
+	return nil
+}
 
-	param := mackerel.CreateRoleParam{
-		Name: role,
+// registerServiceRole creates the service and the role if they are not exist.
+// The memos of them are made from labels.
+func (e *Exporter) registerServiceRole(ctx context.Context, s, role string, labels *label.Set) error {
+	if err := e.registerService(ctx, s, labels); err != nil {
+		return err
+	}
+	if e.hasServiceRole(s, role) {
+		return nil
+	}
+	unlock, err := e.lockEntity(ctx, entityKey("role", s+":"+role))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if e.hasServiceRole(s, role) {
+		return nil
 	}
-	if _, err := e.c.CreateRole(s, &param); err != nil {
+	a, err := e.c.FindRoles(ctx, s)
+	if err != nil {
 		return err
 	}
+	if !containsRole(a, role) {
+		param := mackerel.CreateRoleParam{
+			Name: role,
+			Memo: memo(e.opts.RoleMemoKeys, labels),
+		}
+		if _, err := e.c.CreateRole(ctx, s, &param); err != nil {
+			return err
+		}
+	}
+	e.entityMu.Lock()
 	e.serviceRoles[s][role] = struct{}{}
+	e.entityMu.Unlock()
+	e.putMetaData(ctx, s, role)
 	return nil
 }
 
-// upsertHost update or insert the host with r.
-func (e *Exporter) upsertHost(r *tag.Resource) (string, error) {
-	param := mackerel.CreateHostParam{
-		Name:             r.Hostname(),
-		CustomIdentifier: r.CustomIdentifier(),
+func containsService(a []*mackerel.Service, name string) bool {
+	for _, s := range a {
+		if s.Name == name {
+			return true
+		}
 	}
-	if roleFullname := r.RoleFullname(); roleFullname != "" {
-		s := r.ServiceName()
-		role := r.RoleName()
-		if err := e.registerServiceRole(s, role); err != nil {
-			return "", err
+	return false
+}
+
+func containsRole(a []*mackerel.Role, name string) bool {
+	for _, r := range a {
+		if r.Name == name {
+			return true
 		}
-		param.RoleFullnames = []string{roleFullname}
 	}
-	if r.Cloud.Provider != "" {
-		param.Meta = mackerel.HostMeta{
-			Cloud: &mackerel.Cloud{
-				Provider: r.Cloud.Provider,
-			},
+	return false
+}
+
+// memo joins values of keys in labels with newlines.
+func memo(keys []label.Key, labels *label.Set) string {
+	if labels == nil {
+		return ""
+	}
+	var a []string
+	for _, k := range keys {
+		if v, ok := labels.Value(k); ok {
+			a = append(a, v.Emit())
 		}
 	}
+	return strings.Join(a, "\n")
+}
 
-	hostID, err := e.lookupHostID(param.CustomIdentifier)
+// putMetaData puts metadata that are set with WithServiceMetaData or WithRoleMetaData.
+// If role is empty, putMetaData puts metadata of the service.
+// Errors are reported to the global error handler because metadata don't block metrics.
+func (e *Exporter) putMetaData(ctx context.Context, service, role string) {
+	for _, m := range e.opts.MetaData {
+		if m.service != service || m.role != role {
+			continue
+		}
+		var err error
+		if role == "" {
+			err = e.c.PutServiceMetaData(ctx, service, m.namespace, m.v)
+		} else {
+			err = e.c.PutRoleMetaData(ctx, service, role, m.namespace, m.v)
+		}
+		if err != nil {
+			global.Handle(&TargetError{Op: OpPutMetaData, Service: service, Err: err})
+		}
+	}
+}
+
+// syncHostStatus updates the status of the host if the host.status attribute differs from the last one.
+// It don't compare status with the current status of the host,
+// so that the status set with SetHostStatus is kept until the attribute is changed.
+func (e *Exporter) syncHostStatus(ctx context.Context, customIdentifier, status string) error {
+	unlock, err := e.lockEntity(ctx, entityKey("host", customIdentifier))
 	if err != nil {
-		return "", err
+		return err
 	}
-	if hostID == "" {
-		return e.c.CreateHost(&param)
+	defer unlock()
+	h, ok := e.lookupHost(customIdentifier)
+	if !ok || h.labelStatus == status {
+		return nil
+	}
+	if err := validateHostStatus(status); err != nil {
+		return err
+	}
+	if err := e.c.UpdateHostStatus(ctx, h.id, status); err != nil {
+		return err
 	}
-	return e.c.UpdateHost(hostID, (*mackerel.UpdateHostParam)(&param))
+	e.updateHost(customIdentifier, func(h *hostEntry) {
+		h.labelStatus = status
+	})
+	return nil
 }
 
-func (e *Exporter) lookupHostID(customIdentifier string) (string, error) {
-	if customIdentifier == "" {
-		return "", errors.New("customIdentifier must be specified")
+// SetHostStatus changes the status of the host identified by customIdentifier.
+// The status must be one of working, standby, maintenance or poweroff.
+// Note that the host.status attribute overwrites the status again when it is changed.
+func (e *Exporter) SetHostStatus(ctx context.Context, customIdentifier, status string) error {
+	if err := validateHostStatus(status); err != nil {
+		return err
 	}
-	a, err := e.c.FindHosts(&mackerel.FindHostsParam{
-		CustomIdentifier: customIdentifier,
-	})
+	unlock, err := e.lockEntity(ctx, entityKey("host", customIdentifier))
 	if err != nil {
-		return "", err
+		return err
 	}
-	if len(a) == 0 {
-		return "", nil
+	defer unlock()
+	h, ok := e.lookupHost(customIdentifier)
+	if !ok {
+		hostID, _, err := e.lookupHostID(ctx, customIdentifier)
+		if err != nil {
+			return err
+		}
+		if hostID == "" {
+			return fmt.Errorf("host %s is not found", customIdentifier)
+		}
+		h = hostEntry{id: hostID}
+	}
+	return e.c.UpdateHostStatus(ctx, h.id, status)
+}
+
+func validateHostStatus(status string) error {
+	switch status {
+	case mackerel.HostStatusWorking, mackerel.HostStatusStandby, mackerel.HostStatusMaintenance, mackerel.HostStatusPoweroff:
+		return nil
+	}
+	return fmt.Errorf("%w: invalid host status: %q", ErrValidation, status)
+}
+
+// upsertHost update or insert the host of reg.entity. Its specs are made from reg.res.
+// It also reports whether the host is created.
+// The caller must hold the entity key of the host.
+func (e *Exporter) upsertHost(ctx context.Context, reg *registration) (string, bool, error) {
+	ent, r := &reg.entity, reg.res
+	name := ent.Hostname
+	if name == "" {
+		name = ent.CustomIdentifier
+	}
+	param := mackerel.CreateHostParam{
+		Name:             name,
+		CustomIdentifier: ent.CustomIdentifier,
+		Meta:             hostMeta(r),
+		Interfaces:       hostInterfaces(r),
+	}
+	if roleFullname := ent.RoleFullname(); roleFullname != "" {
+		s := ent.Service
+		role := ent.Role
+		if err := e.registerServiceRole(ctx, s, role, reg.labels); err != nil {
+			return "", false, err
+		}
+		param.RoleFullnames = []string{roleFullname}
+	}
+	hostID, cached, err := e.lookupHostID(ctx, param.CustomIdentifier)
+	if err != nil {
+		return "", false, err
+	}
+	if hostID != "" {
+		id, err := e.c.UpdateHost(ctx, hostID, (*mackerel.UpdateHostParam)(&param))
+		if err == nil || !cached || !isNotFound(err) {
+			return id, false, err
+		}
+
+		// The cached host was retired or deleted by others.
+		e.entityMu.Lock()
+		e.hostCache.remove(param.CustomIdentifier)
+		e.entityMu.Unlock()
+		if hostID, _, err = e.lookupHostID(ctx, param.CustomIdentifier); err != nil {
+			return "", false, err
+		}
+		if hostID != "" {
+			id, err := e.c.UpdateHost(ctx, hostID, (*mackerel.UpdateHostParam)(&param))
+			return id, false, err
+		}
+	}
+	hostID, err = e.c.CreateHost(ctx, &param)
+	if err != nil {
+		return "", false, err
 	}
-	return a[0].ID, nil
+	e.entityMu.Lock()
+	e.hostCache.set(param.CustomIdentifier, hostID)
+	e.entityMu.Unlock()
+	return hostID, true, nil
 }
@@ -1 +1,315 @@
 package mackerel
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/tag"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func TestExporterRetireHosts(t *testing.T) {
+	ctx := context.Background()
+	c := &handlerClient{}
+	if _, err := c.CreateHost(ctx, &mackerel.CreateHostParam{Name: "old", CustomIdentifier: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExporter(t, c, WithRetireCreatedHostsOnly())
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{KeyHostID.String("old")}},
+		testRecord{"requests", 1, []label.KeyValue{KeyHostID.String("new")}},
+		testRecord{"requests", 1, []label.KeyValue{KeyHostID.String("alive")}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	now := time.Now()
+	e.hosts["old"].lastSeen = now.Add(-time.Hour)
+	e.hosts["new"].lastSeen = now.Add(-time.Hour)
+	if err := e.retireHosts(ctx, now.Add(-time.Minute)); err != nil {
+		t.Fatalf("retireHosts() = %v", err)
+	}
+	for id, want := range map[string]bool{"old": false, "new": true, "alive": false} {
+		a, err := c.FindHosts(ctx, &mackerel.FindHostsParam{CustomIdentifier: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retired := len(a) == 0; retired != want {
+			t.Errorf("%s is retired = %t; want %t", id, retired, want)
+		}
+		if _, ok := e.hosts[id]; ok == want {
+			t.Errorf("%s is tracked = %t; want %t", id, ok, !want)
+		}
+	}
+}
+
+func TestExporterRetireOnShutdown(t *testing.T) {
+	ctx := context.Background()
+	c := &handlerClient{}
+	e := newTestExporter(t, c, WithRetireOnShutdown())
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{KeyHostID.String("1-2-3-4")}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if n := len(e.hosts); n != 0 {
+		t.Errorf("len(hosts) = %d; want 0", n)
+	}
+	for _, h := range c.hosts {
+		if !h.IsRetired {
+			t.Errorf("%s is not retired", h.CustomIdentifier)
+		}
+	}
+}
+
+func TestExporterHostStatus(t *testing.T) {
+	ctx := context.Background()
+	c := &handlerClient{}
+	e := newTestExporter(t, c)
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{
+			KeyHostID.String("1-2-3-4"),
+			KeyHostStatus.String(mackerel.HostStatusMaintenance),
+		}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	hostID := e.hosts["1-2-3-4"].id
+	if s := c.hosts[hostID].Status; s != mackerel.HostStatusMaintenance {
+		t.Errorf("Status = %q; want %q", s, mackerel.HostStatusMaintenance)
+	}
+
+	if err := e.SetHostStatus(ctx, "1-2-3-4", mackerel.HostStatusWorking); err != nil {
+		t.Fatalf("SetHostStatus() = %v", err)
+	}
+	if s := c.hosts[hostID].Status; s != mackerel.HostStatusWorking {
+		t.Errorf("Status = %q; want %q", s, mackerel.HostStatusWorking)
+	}
+
+	// The unchanged attribute must not overwrite the status that is set with SetHostStatus.
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if s := c.hosts[hostID].Status; s != mackerel.HostStatusWorking {
+		t.Errorf("Status after Export = %q; want %q", s, mackerel.HostStatusWorking)
+	}
+	cs = newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{
+			KeyHostID.String("1-2-3-4"),
+			KeyHostStatus.String(mackerel.HostStatusStandby),
+		}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if s := c.hosts[hostID].Status; s != mackerel.HostStatusStandby {
+		t.Errorf("Status after the attribute is changed = %q; want %q", s, mackerel.HostStatusStandby)
+	}
+
+	if err := e.SetHostStatus(ctx, "1-2-3-4", "sleeping"); !errors.Is(err, ErrValidation) {
+		t.Errorf("SetHostStatus(sleeping) = %v; want %v", err, ErrValidation)
+	}
+	if err := e.SetHostStatus(ctx, "unknown", mackerel.HostStatusWorking); err == nil {
+		t.Error("SetHostStatus(unknown) = nil; want an error")
+	}
+}
+
+func TestExporterSyncHostRoles(t *testing.T) {
+	ctx := context.Background()
+	c := &handlerClient{}
+	e := newTestExporter(t, c)
+	host := KeyHostID.String("1-2-3-4")
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{host, KeyServiceNS.String("service"), KeyServiceName.String("web")}},
+		testRecord{"errors", 1, []label.KeyValue{host, KeyServiceNS.String("service"), KeyServiceName.String("batch")}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	h := c.hosts[e.hosts["1-2-3-4"].id]
+	if want := (mackerel.Roles{"service": {"batch", "web"}}); !reflect.DeepEqual(h.Roles, want) {
+		t.Errorf("Roles = %v; want %v", h.Roles, want)
+	}
+
+	// The instrument for batch is quiet in this period.
+	cs = newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{host, KeyServiceNS.String("service"), KeyServiceName.String("api")}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if want := (mackerel.Roles{"service": {"api", "batch", "web"}}); !reflect.DeepEqual(h.Roles, want) {
+		t.Errorf("Roles = %v; want %v", h.Roles, want)
+	}
+	if _, ok := c.roles["service"]["api"]; !ok {
+		t.Error("role api is not created")
+	}
+
+	// The roles that are not reported for a long time are removed.
+	old := time.Now().Add(-(roleTTLPeriods + 1) * defaultPeriod)
+	e.hosts["1-2-3-4"].roleSeen["service:batch"] = old
+	e.hosts["1-2-3-4"].roleSeen["service:web"] = old
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if want := (mackerel.Roles{"service": {"api"}}); !reflect.DeepEqual(h.Roles, want) {
+		t.Errorf("Roles = %v; want %v", h.Roles, want)
+	}
+}
+
+func TestExporterServiceMemoAndMetaData(t *testing.T) {
+	ctx := context.Background()
+	c := &handlerClient{}
+	description := label.Key("description")
+	e := newTestExporter(t, c,
+		WithServiceMemo(description),
+		WithRoleMemo(KeyServiceVersion, description),
+		WithServiceMetaData("service", "catalog", map[string]string{"owner": "team-a"}),
+		WithRoleMetaData("service", "web", "catalog", map[string]string{"tier": "frontend"}),
+	)
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{
+			KeyHostID.String("1-2-3-4"),
+			KeyServiceNS.String("service"),
+			KeyServiceName.String("web"),
+			KeyServiceVersion.String("v1.0.0"),
+			description.String("frontend servers"),
+		}},
+	)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if s := c.services["service"].Memo; s != "frontend servers" {
+		t.Errorf("service memo = %q; want %q", s, "frontend servers")
+	}
+	if s := c.roles["service"]["web"].Memo; s != "v1.0.0\nfrontend servers" {
+		t.Errorf("role memo = %q; want %q", s, "v1.0.0\nfrontend servers")
+	}
+	for _, path := range []string{"services/service/catalog", "services/service/roles/web/catalog"} {
+		if _, ok := c.metadata[path]; !ok {
+			t.Errorf("metadata %s is not put", path)
+		}
+	}
+}
+
+func TestExporterHostMetaData(t *testing.T) {
+	ctx := context.Background()
+	c := &handlerClient{}
+	e := newTestExporter(t, c, WithHostMetaData("inventory", "service.version", "process.runtime.*"))
+	labels := func(version string) []label.KeyValue {
+		return []label.KeyValue{
+			KeyHostID.String("1-2-3-4"),
+			KeyServiceVersion.String(version),
+			label.String("process.runtime.name", "go"),
+			label.String("http.method", "GET"),
+		}
+	}
+	if err := e.Export(ctx, newCheckpointSet(t, testRecord{"requests", 1, labels("v1")})); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	path := "hosts/" + e.hosts["1-2-3-4"].id + "/inventory"
+	want := map[string]interface{}{
+		"service.version":      "v1",
+		"process.runtime.name": "go",
+	}
+	if m := c.metadata[path]; !reflect.DeepEqual(m, want) {
+		t.Errorf("metadata = %v; want %v", m, want)
+	}
+
+	if err := e.Export(ctx, newCheckpointSet(t, testRecord{"requests", 1, labels("v2")})); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	want["service.version"] = "v2"
+	if m := c.metadata[path]; !reflect.DeepEqual(m, want) {
+		t.Errorf("metadata = %v; want %v", m, want)
+	}
+
+	// The keys from the record that is not exported in this period are kept.
+	cs := newCheckpointSet(t, testRecord{"errors", 1, []label.KeyValue{
+		KeyHostID.String("1-2-3-4"),
+		KeyServiceVersion.String("v2"),
+	}})
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if m := c.metadata[path]; !reflect.DeepEqual(m, want) {
+		t.Errorf("metadata = %v; want %v", m, want)
+	}
+}
+
+// blockingClient blocks creating the host "slow" until release is closed.
+type blockingClient struct {
+	*handlerClient
+	started chan struct{}
+	release chan struct{}
+	created int32
+}
+
+func (c *blockingClient) CreateHost(ctx context.Context, param *mackerel.CreateHostParam) (string, error) {
+	if param.CustomIdentifier == "slow" {
+		if atomic.AddInt32(&c.created, 1) == 1 {
+			close(c.started)
+		}
+		<-c.release
+	}
+	return c.handlerClient.CreateHost(ctx, param)
+}
+
+func TestExporterRegisterHostConcurrently(t *testing.T) {
+	ctx := context.Background()
+	c := &blockingClient{
+		handlerClient: &handlerClient{},
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	e := newTestExporter(t, c)
+	reg := func(id string) *registration {
+		return &registration{
+			entity: Entity{CustomIdentifier: id},
+			res:    &tag.Resource{},
+		}
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]string, 2)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := e.registerHost(ctx, reg("slow"))
+			if err != nil {
+				t.Errorf("registerHost(slow) = %v", err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	<-c.started
+
+	// The other hosts must not wait for the host that is being created.
+	fastCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := e.registerHost(fastCtx, reg("fast")); err != nil {
+		t.Errorf("registerHost(fast) = %v", err)
+	}
+	close(c.release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&c.created); n != 1 {
+		t.Errorf("CreateHost(slow) is called %d times; want 1", n)
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("registerHost(slow) = %q and %q; want the same ID", ids[0], ids[1])
+	}
+}
@@ -0,0 +1,251 @@
+package mackerel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/graphdef"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// These errors are used to classify *APIError with errors.Is.
+var (
+	// ErrUnauthorized means the API key is invalid or it don't have the permission.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrRateLimited means the request is rejected due to the rate limit of Mackerel API.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrValidation means the request is rejected because its parameters are invalid.
+	ErrValidation = errors.New("validation failed")
+)
+
+var (
+	// ErrShutdown is returned by Export after the exporter is shut down.
+	ErrShutdown = errors.New("the exporter is shut down")
+
+	// ErrNotDelivered means metrics were not delivered until the exporter is shut down.
+	ErrNotDelivered = errors.New("not delivered")
+)
+
+// APIError records an error of Mackerel API.
+type APIError struct {
+	// StatusCode is HTTP status code of the response.
+	// It will be 0 if the exporter could not receive any response.
+	StatusCode int
+
+	// Endpoint is the method and the path pattern of the API, such as "POST /api/v0/tsdb".
+	Endpoint string
+
+	// HostID is Mackerel's host ID that is affected by the error.
+	HostID string
+
+	// Service is the name of the service that is affected by the error.
+	Service string
+
+	// Err is the underlying error. It is *mackerel.APIError if the API returned an error.
+	Err error
+}
+
+func wrapAPIError(err error, endpoint, hostID, service string) error {
+	if err == nil {
+		return nil
+	}
+	e := &APIError{
+		Endpoint: endpoint,
+		HostID:   hostID,
+		Service:  service,
+		Err:      err,
+	}
+	var p *mackerel.APIError
+	if errors.As(err, &p) {
+		e.StatusCode = p.StatusCode
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	s := e.Endpoint
+	if e.HostID != "" {
+		s += " (host " + e.HostID + ")"
+	}
+	if e.Service != "" {
+		s += " (service " + e.Service + ")"
+	}
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: status %d: %v", s, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", s, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether e is classified to target.
+// The target should be one of ErrUnauthorized, ErrRateLimited or ErrValidation.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrValidation:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	}
+	return false
+}
+
+// Temporary reports whether the request might succeed if it is retried.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// isTemporary reports whether err might be resolved by retrying.
+// Errors that are not *APIError, such as I/O errors, are assumed to be temporary.
+func isTemporary(err error) bool {
+	var p *APIError
+	if errors.As(err, &p) {
+		return p.Temporary()
+	}
+	return true
+}
+
+// GraphDefConflictError is reported when Graph Definitions for the same graph are inconsistent in an export,
+// such as metrics with different units. The exporter keeps the first definition.
+type GraphDefConflictError = graphdef.ConflictError
+
+// Op represents a step of the export.
+type Op string
+
+// These are steps of the export.
+const (
+	OpConvertRecord      Op = "convert record"
+	OpUpsertHost         Op = "upsert host"
+	OpRegisterService    Op = "register service"
+	OpCreateGraphDefs    Op = "create graph-defs"
+	OpPostHostMetrics    Op = "post host metrics"
+	OpPostServiceMetrics Op = "post service metrics"
+	OpResendMetrics      Op = "resend metrics"
+	OpRetireHost         Op = "retire host"
+	OpUpdateHostStatus   Op = "update host status"
+	OpUpdateHostRoles    Op = "update host roles"
+	OpSyncHosts          Op = "sync hosts"
+	OpPutMetaData        Op = "put metadata"
+)
+
+// TargetError records an error and the step and the target that caused it.
+type TargetError struct {
+	Op Op
+
+	// Host is the customIdentifier of the host if the target is a host.
+	Host string
+
+	// Service is the name of the service if the target is a service.
+	Service string
+
+	// GraphDef is the name of the graph definition if the target is a graph definition.
+	GraphDef string
+
+	// Chunk is 1-based index of the request if metrics were split into Chunks requests.
+	// It is 0 if metrics were not split.
+	Chunk  int
+	Chunks int
+
+	Err error
+}
+
+func (e *TargetError) Error() string {
+	var target string
+	switch {
+	case e.Host != "":
+		target = " for host " + e.Host
+	case e.Service != "":
+		target = " for service " + e.Service
+	case e.GraphDef != "":
+		target = " for graph " + e.GraphDef
+	}
+	if e.Chunk > 0 {
+		target += fmt.Sprintf(" (chunk %d/%d)", e.Chunk, e.Chunks)
+	}
+	return fmt.Sprintf("can't %s%s: %v", e.Op, target, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// queued reports whether the metrics that caused e are held to resend.
+func (e *TargetError) queued() bool {
+	switch e.Op {
+	case OpPostHostMetrics, OpPostServiceMetrics, OpResendMetrics:
+		return isTemporary(e.Err)
+	}
+	return false
+}
+
+// ExportError is returned by Export if it failed to export some of targets.
+// The other targets are exported even if the ExportError is returned.
+type ExportError struct {
+	Errors []*TargetError
+}
+
+func (e *ExportError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	a := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		a[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(e.Errors), strings.Join(a, "; "))
+}
+
+// Is reports whether any error in e matches target.
+func (e *ExportError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in e that matches target.
+func (e *ExportError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ExportError) add(err *TargetError) {
+	e.Errors = append(e.Errors, err)
+}
+
+// merge appends errors of err if err is *ExportError, otherwise appends err itself.
+func (e *ExportError) merge(op Op, err error) {
+	if p, ok := err.(*ExportError); ok {
+		e.Errors = append(e.Errors, p.Errors...)
+		return
+	}
+	if p, ok := err.(*TargetError); ok {
+		e.add(p)
+		return
+	}
+	e.add(&TargetError{Op: op, Err: err})
+}
+
+// err returns nil if e has no errors.
+func (e *ExportError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,60 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		status    int
+		want      error
+		temporary bool
+	}{
+		{status: http.StatusUnauthorized, want: ErrUnauthorized},
+		{status: http.StatusForbidden, want: ErrUnauthorized},
+		{status: http.StatusTooManyRequests, want: ErrRateLimited, temporary: true},
+		{status: http.StatusBadRequest, want: ErrValidation},
+		{status: http.StatusInternalServerError, temporary: true},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error":{"message":"failed"}}`, tt.status)
+		}))
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := mackerel.NewClient("dummy")
+		p.BaseURL = u
+		c := &apiClient{c: p}
+		err = c.PostServiceMetricValues(context.Background(), "service", nil)
+		ts.Close()
+
+		var e *APIError
+		if !errors.As(err, &e) {
+			t.Fatalf("PostServiceMetricValues() = %v; want *APIError", err)
+		}
+		if e.StatusCode != tt.status || e.Service != "service" {
+			t.Errorf("APIError = %+v; want StatusCode = %d, Service = service", e, tt.status)
+		}
+		for _, target := range []error{ErrUnauthorized, ErrRateLimited, ErrValidation} {
+			if ok := errors.Is(err, target); ok != (target == tt.want) {
+				t.Errorf("errors.Is(%v, %v) = %t", err, target, ok)
+			}
+		}
+		if e.Temporary() != tt.temporary {
+			t.Errorf("Temporary() = %t; want %t", e.Temporary(), tt.temporary)
+		}
+		var p2 *mackerel.APIError
+		if !errors.As(err, &p2) {
+			t.Errorf("%v does not wrap *mackerel.APIError", err)
+		}
+	}
+}
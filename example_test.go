@@ -1,9 +1,11 @@
 package mackerel_test
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/mackerelio-labs/mackerelexporter-go"
 )
@@ -23,7 +25,13 @@ func ExampleInstallNewPipeline_pushMode() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer pusher.Stop()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := pusher.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
 }
 
 func ExampleInstallNewPipeline_pullMode() {
@@ -2,10 +2,12 @@ package mackerel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel/api/global"
@@ -25,7 +27,7 @@ import (
 )
 
 // InstallNewPipeline instantiates a NewExportPipeline and registers it globally.
-func InstallNewPipeline(opts ...Option) (*push.Controller, http.HandlerFunc, error) {
+func InstallNewPipeline(opts ...Option) (*Pipeline, http.HandlerFunc, error) {
 	pusher, handler, err := NewExportPipeline(opts...)
 	if err != nil {
 		return nil, nil, err
@@ -35,7 +37,9 @@ func InstallNewPipeline(opts ...Option) (*push.Controller, http.HandlerFunc, err
 }
 
 // NewExportPipeline sets up a complete export pipeline.
-func NewExportPipeline(opts ...Option) (*push.Controller, http.HandlerFunc, error) {
+// Stop of the returned controller exports metrics one last time,
+// and it will be canceled if the export don't finish within the timeout.
+func NewExportPipeline(opts ...Option) (*Pipeline, http.HandlerFunc, error) {
 	// There are few types in simple; inexpensive, sketch, exact.
 	s := simple.NewWithExactDistribution()
 	exporter, err := NewExporter(opts...)
@@ -43,14 +47,20 @@ func NewExportPipeline(opts ...Option) (*push.Controller, http.HandlerFunc, erro
 		return nil, nil, err
 	}
 	var o []push.Option
-	o = append(o, push.WithPeriod(time.Minute))
+	o = append(o, push.WithPeriod(exporter.opts.Period))
+	if exporter.opts.Timeout > 0 {
+		o = append(o, push.WithTimeout(exporter.opts.Timeout))
+	}
 	if len(exporter.opts.Tags) > 0 {
 		res := resource.New(exporter.opts.Tags...)
 		o = append(o, push.WithResource(res))
 	}
 
 	p := processor.New(s, exporter)
-	pusher := push.New(p, exporter, o...)
+	pusher := &Pipeline{
+		Controller: push.New(p, exporter, o...),
+		exporter:   exporter,
+	}
 	pusher.Start()
 
 	if h, _ := exporter.c.(http.Handler); h != nil {
@@ -59,6 +69,37 @@ func NewExportPipeline(opts ...Option) (*push.Controller, http.HandlerFunc, erro
 	return pusher, nil, nil
 }
 
+// Pipeline is a push controller that exports metrics to Mackerel periodically.
+type Pipeline struct {
+	*push.Controller
+	exporter *Exporter
+}
+
+// Exporter returns the exporter that is used by p.
+func (p *Pipeline) Exporter() *Exporter {
+	return p.exporter
+}
+
+// Shutdown stops p after it collects and exports metrics one last time,
+// then it shuts down the exporter. See Exporter.Shutdown for details.
+// If ctx is done before the last export is finished, the export will be canceled.
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Stop()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.exporter.abort()
+		<-done
+	}
+	return p.exporter.Shutdown(ctx)
+}
+
+const defaultPeriod = time.Minute
+
 // Option is function type that is passed to NewExporter function.
 type Option func(*options)
 
@@ -66,9 +107,59 @@ type options struct {
 	APIKey    string
 	Quantiles []float64
 	Hints     []string
+	GraphDefs []GraphSpec
 	BaseURL   *url.URL
 	Tags      []label.KeyValue
 	Debug     bool
+
+	MaxRetries   int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	MaxQueueSize int
+	MaxQueueAge  time.Duration
+	SpoolDir     string
+
+	RequestInterval time.Duration
+
+	client mackerelClient // overrides the client made from APIKey; for testing
+
+	MaxValuesPerRequest int
+	Concurrency         int
+
+	Period  time.Duration
+	Timeout time.Duration
+
+	ResourceMapping ResourceMapping
+	EntityMapper    EntityMapper
+
+	RetireAfter            time.Duration
+	RetireOnShutdown       bool
+	RetireCreatedHostsOnly bool
+
+	HostSync         *HostSyncFilter
+	HostSyncInterval time.Duration
+	HostCacheFile    string
+
+	ServiceMemoKeys []label.Key
+	RoleMemoKeys    []label.Key
+	MetaData        []metaDataSpec
+
+	HostMetaDataNamespace string
+	HostMetaDataPatterns  []string
+
+	GraphDefPolicy    GraphDefPolicy
+	GraphDefCacheFile string
+	ForeignGraphDefs  []string
+
+	LegacyServiceMetricNames bool
+}
+
+// metaDataSpec is metadata that is attached to the service or the role.
+type metaDataSpec struct {
+	service   string
+	role      string // empty if the metadata is for the service
+	namespace string
+	v         interface{}
 }
 
 // WithAPIKey sets the Mackerel API Key.
@@ -98,6 +189,53 @@ func WithHints(hints []string) Option {
 	}
 }
 
+// GraphSpec overrides the Graph Definition of metrics that match Name.
+type GraphSpec struct {
+	// Name is the name of the Graph Definition. It can contain wildcards like hints.
+	Name string
+
+	DisplayName string
+	Unit        string // Mackerel's unit, such as "bytes/sec" or "percentage"
+	IsStacked   bool
+
+	// Series maps the last element of metric names to their display names.
+	// For ValueRecorder metrics, the element is "min", "max" or "percentile_NN".
+	Series map[string]string
+}
+
+// WithGraphDefs sets specs of Graph Definitions.
+// These take precedence over hints.
+func WithGraphDefs(specs []GraphSpec) Option {
+	return func(o *options) {
+		o.GraphDefs = specs
+	}
+}
+
+// WithGraphDefPolicy sets the policy to overwrite Graph Definitions that already exist.
+// The default is GraphDefOverwrite. Other policies require WithGraphDefCacheFile
+// because the exporter knows existing definitions only from the cache after it is restarted.
+func WithGraphDefPolicy(policy GraphDefPolicy) Option {
+	return func(o *options) {
+		o.GraphDefPolicy = policy
+	}
+}
+
+// WithGraphDefCacheFile persists Graph Definitions that the exporter has posted to file,
+// so that the exporter don't post them again after it is restarted.
+func WithGraphDefCacheFile(file string) Option {
+	return func(o *options) {
+		o.GraphDefCacheFile = file
+	}
+}
+
+// WithForeignGraphDefs declares names of Graph Definitions that are created by others, such as Mackerel's web UI.
+// The exporter don't overwrite them unless the policy is GraphDefOverwrite.
+func WithForeignGraphDefs(names ...string) Option {
+	return func(o *options) {
+		o.ForeignGraphDefs = names
+	}
+}
+
 // WithBaseURL sets base URL for Mackerel API.
 func WithBaseURL(baseURL *url.URL) Option {
 	return func(o *options) {
@@ -119,64 +257,362 @@ func WithDebug() Option {
 	}
 }
 
+// WithPeriod sets the interval of exports. The default is 1 minute.
+// Mackerel stores metrics at 1 minute granularity, so shorter period is not useful.
+// The period must be positive.
+func WithPeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.Period = d
+	}
+}
+
+// WithTimeout sets the time limit of each export.
+// The default is same as the period.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.Timeout = d
+	}
+}
+
+// WithMaxRetries sets the maximum number of retries when the exporter failed to post metrics.
+// Zero disables retries.
+func WithMaxRetries(n int) Option {
+	return func(o *options) {
+		o.MaxRetries = n
+	}
+}
+
+// WithRetryBackoff sets the range of the wait time between retries.
+// The wait time grows exponentially from min to max, and it is randomized with jitter.
+func WithRetryBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.MinBackoff = min
+		o.MaxBackoff = max
+	}
+}
+
+// WithMaxQueueSize sets the maximum number of metric batches that the exporter holds to resend.
+// The batch is a set of host metrics, or service metrics for a service, in an export.
+// When the queue is full, the oldest batch will be dropped. Zero disables resending.
+// It also limits the number of files in the spool that is set with WithSpoolDir.
+func WithMaxQueueSize(n int) Option {
+	return func(o *options) {
+		o.MaxQueueSize = n
+	}
+}
+
+// WithMaxQueueAge sets the maximum age of the metric batches that the exporter holds to resend.
+// Zero means the batches never expire. It also applies to the spool, but the spooled batches
+// expire after 24 hours at most.
+func WithMaxQueueAge(d time.Duration) Option {
+	return func(o *options) {
+		o.MaxQueueAge = d
+	}
+}
+
+// WithRequestInterval sets the minimum interval between requests to Mackerel API.
+// The exporter makes the interval longer than d adaptively while Mackerel rejects requests
+// due to its rate limit. Zero means the exporter don't throttle requests until it is rate limited.
+func WithRequestInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.RequestInterval = d
+	}
+}
+
+// WithMaxValuesPerRequest sets the maximum number of metric values in a request.
+// The exporter splits metrics into multiple requests if there are more values than n.
+// Zero means no limit. It has no effect in the pull mode.
+func WithMaxValuesPerRequest(n int) Option {
+	return func(o *options) {
+		o.MaxValuesPerRequest = n
+	}
+}
+
+// WithConcurrency sets the maximum number of requests that post metrics concurrently.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.Concurrency = n
+	}
+}
+
+// WithSpoolDir sets the directory to store metric batches that the exporter failed to post.
+// If it is set, the batches are written into files instead of the memory,
+// and the exporter resends them even if the process is restarted.
+// NewExporter starts resending the files that are left in dir in background.
+func WithSpoolDir(dir string) Option {
+	return func(o *options) {
+		o.SpoolDir = dir
+	}
+}
+
+// WithResourceMapping sets how the exporter maps Kubernetes or container attributes
+// to Mackerel's hosts, services and roles. By default, these attributes are ignored.
+func WithResourceMapping(m ResourceMapping) Option {
+	return func(o *options) {
+		o.ResourceMapping = m
+	}
+}
+
+// WithEntityMapper sets the mapper that decides the host or the service of each record.
+// It takes precedence over WithResourceMapping. See DefaultEntityMapper for the default.
+func WithEntityMapper(m EntityMapper) Option {
+	return func(o *options) {
+		o.EntityMapper = m
+	}
+}
+
+// WithRetireAfter makes the exporter retire hosts that have not reported metrics for d.
+// Zero disables the retirement.
+func WithRetireAfter(d time.Duration) Option {
+	return func(o *options) {
+		o.RetireAfter = d
+	}
+}
+
+// WithLegacyServiceMetricNames makes the exporter prefix names of service metrics with "custom."
+// as older versions did, so that existing graphs and monitors keep working.
+// In this mode, hints and GraphSpec don't group service metrics.
+func WithLegacyServiceMetricNames() Option {
+	return func(o *options) {
+		o.LegacyServiceMetricNames = true
+	}
+}
+
+// WithRetireOnShutdown makes the exporter retire all hosts that it has reported when it is shut down.
+func WithRetireOnShutdown() Option {
+	return func(o *options) {
+		o.RetireOnShutdown = true
+	}
+}
+
+// WithRetireCreatedHostsOnly restricts the retirement to hosts that the exporter created by itself.
+// Hosts that already existed in Mackerel before the exporter started are never retired.
+func WithRetireCreatedHostsOnly() Option {
+	return func(o *options) {
+		o.RetireCreatedHostsOnly = true
+	}
+}
+
+// WithHostSync makes the exporter list hosts filtered by f at once before the first export,
+// and caches their host IDs to avoid looking up hosts one by one.
+// The list is refreshed every interval. Zero interval means the list is never refreshed.
+// The list is merged into the cache, so hosts out of f are kept in the cache.
+func WithHostSync(f HostSyncFilter, interval time.Duration) Option {
+	return func(o *options) {
+		o.HostSync = &f
+		o.HostSyncInterval = interval
+	}
+}
+
+// WithHostCacheFile sets the file to persist host IDs that the exporter looked up or created,
+// so that the exporter don't look up them again after restarts.
+func WithHostCacheFile(file string) Option {
+	return func(o *options) {
+		o.HostCacheFile = file
+	}
+}
+
+// WithServiceMemo sets label keys to make the memo of services that the exporter creates.
+// The memo is values of the keys joined with newlines.
+func WithServiceMemo(keys ...label.Key) Option {
+	return func(o *options) {
+		o.ServiceMemoKeys = keys
+	}
+}
+
+// WithRoleMemo sets label keys to make the memo of roles that the exporter creates.
+// The memo is values of the keys joined with newlines.
+func WithRoleMemo(keys ...label.Key) Option {
+	return func(o *options) {
+		o.RoleMemoKeys = keys
+	}
+}
+
+// WithServiceMetaData attaches the metadata v to the service under namespace.
+// The metadata is put when the exporter registers the service.
+// v must be able to be encoded to JSON.
+func WithServiceMetaData(service, namespace string, v interface{}) Option {
+	return func(o *options) {
+		o.MetaData = append(o.MetaData, metaDataSpec{
+			service:   service,
+			namespace: namespace,
+			v:         v,
+		})
+	}
+}
+
+// WithRoleMetaData attaches the metadata v to the role under namespace.
+// The metadata is put when the exporter registers the role.
+// v must be able to be encoded to JSON.
+func WithRoleMetaData(service, role, namespace string, v interface{}) Option {
+	return func(o *options) {
+		o.MetaData = append(o.MetaData, metaDataSpec{
+			service:   service,
+			role:      role,
+			namespace: namespace,
+			v:         v,
+		})
+	}
+}
+
+// WithHostMetaData makes the exporter publish labels that match patterns as metadata of hosts under namespace.
+// The pattern is a label key, and its elements separated by dots can be the wildcard "*",
+// such as "process.runtime.*". The metadata is a JSON object that maps keys to values.
+// It is updated whenever the labels are changed.
+func WithHostMetaData(namespace string, patterns ...string) Option {
+	return func(o *options) {
+		o.HostMetaDataNamespace = namespace
+		o.HostMetaDataPatterns = patterns
+	}
+}
+
 type mackerelClient interface {
-	FindServices() ([]*mackerel.Service, error)
-	CreateService(param *mackerel.CreateServiceParam) (*mackerel.Service, error)
-	FindRoles(serviceName string) ([]*mackerel.Role, error)
-	CreateRole(serviceName string, param *mackerel.CreateRoleParam) (*mackerel.Role, error)
+	FindServices(ctx context.Context) ([]*mackerel.Service, error)
+	CreateService(ctx context.Context, param *mackerel.CreateServiceParam) (*mackerel.Service, error)
+	FindRoles(ctx context.Context, serviceName string) ([]*mackerel.Role, error)
+	CreateRole(ctx context.Context, serviceName string, param *mackerel.CreateRoleParam) (*mackerel.Role, error)
 
-	FindHosts(param *mackerel.FindHostsParam) ([]*mackerel.Host, error)
-	CreateHost(param *mackerel.CreateHostParam) (string, error)
-	UpdateHost(hostID string, param *mackerel.UpdateHostParam) (string, error)
+	FindHosts(ctx context.Context, param *mackerel.FindHostsParam) ([]*mackerel.Host, error)
+	CreateHost(ctx context.Context, param *mackerel.CreateHostParam) (string, error)
+	UpdateHost(ctx context.Context, hostID string, param *mackerel.UpdateHostParam) (string, error)
+	RetireHost(ctx context.Context, hostID string) error
+	UpdateHostStatus(ctx context.Context, hostID, status string) error
+	UpdateHostRoleFullnames(ctx context.Context, hostID string, roleFullnames []string) error
+	PutServiceMetaData(ctx context.Context, serviceName, namespace string, v interface{}) error
+	PutRoleMetaData(ctx context.Context, serviceName, roleName, namespace string, v interface{}) error
+	PutHostMetaData(ctx context.Context, hostID, namespace string, v interface{}) error
 
-	CreateGraphDefs(defs []*mackerel.GraphDefsParam) error
-	PostHostMetricValues(metrics []*mackerel.HostMetricValue) error
-	PostServiceMetricValues(name string, metrics []*mackerel.MetricValue) error
+	CreateGraphDefs(ctx context.Context, defs []*mackerel.GraphDefsParam) error
+	PostHostMetricValues(ctx context.Context, metrics []*mackerel.HostMetricValue) error
+	PostServiceMetricValues(ctx context.Context, name string, metrics []*mackerel.MetricValue) error
 }
 
 // Exporter is a stats exporter that uploads data to Mackerel.
+// It is safe to call Export from multiple goroutines.
 type Exporter struct {
 	c    mackerelClient
 	opts *options
 
-	hosts           map[string]string // value is Mackerel's host ID
-	serviceRoles    map[string]map[string]struct{}
-	graphDefs       map[string]*mackerel.GraphDefsParam
-	graphMetricDefs map[string]struct{}
+	backoff *backoff
+	queue   *resendQueue
+	spool   *spool
+	limiter *rateLimiter
+
+	entityMu     sync.Mutex            // guards hosts, hostCache, serviceRoles and inflight
+	hosts        map[string]*hostEntry // key is customIdentifier
+	hostCache    *hostCache
+	serviceRoles map[string]map[string]struct{}
+	inflight     map[string]chan struct{} // entity keys that are held by lockEntity
+
+	graphMu    sync.Mutex // guards graphCache
+	graphCache *graphCache
+
+	saveMu sync.Mutex // serializes writes of the cache files
+
+	mu        sync.Mutex // guards closed and lastErr
+	wg        sync.WaitGroup
+	closed    bool
+	lastErr   error
+	aborted   chan struct{}
+	abortOnce sync.Once
 }
 
 var _ export.Exporter = &Exporter{}
 
 // NewExporter creates a new Exporter.
 func NewExporter(opts ...Option) (*Exporter, error) {
-	var o options
+	o := options{
+		MaxRetries:   defaultMaxRetries,
+		MinBackoff:   defaultMinBackoff,
+		MaxBackoff:   defaultMaxBackoff,
+		MaxQueueSize: defaultMaxQueueSize,
+		MaxQueueAge:  defaultMaxQueueAge,
+
+		MaxValuesPerRequest: defaultMaxValuesPerRequest,
+		Concurrency:         defaultConcurrency,
+
+		Period: defaultPeriod,
+	}
 	for _, opt := range opts {
 		opt(&o)
 	}
+	if o.Period <= 0 {
+		return nil, fmt.Errorf("period must be positive: %v", o.Period)
+	}
+	if o.GraphDefPolicy != GraphDefOverwrite && o.GraphDefCacheFile == "" {
+		// The exporter can't know definitions in Mackerel after the restart without the cache.
+		return nil, errors.New("the graph definition policy requires the graph definition cache file")
+	}
 	if o.Quantiles == nil {
 		// This values equal to stdout exporter's values
 		o.Quantiles = []float64{0.5, 0.9, 0.99}
 	}
-	var c mackerelClient = &handlerClient{}
+	var (
+		c mackerelClient = &handlerClient{}
+		l *rateLimiter
+	)
 	if o.APIKey != "" {
 		p := mackerel.NewClient(o.APIKey)
 		if o.BaseURL != nil {
 			p.BaseURL = o.BaseURL
 		}
 		p.Verbose = o.Debug
-		c = p
+		l = newRateLimiter(o.RequestInterval)
+		p.HTTPClient.Transport = &retryAfterTransport{
+			base:    p.HTTPClient.Transport,
+			limiter: l,
+		}
+		c = &limitedClient{c: &apiClient{c: p}, limiter: l}
+	} else {
+		// The pull mode holds only the last posted host metrics.
+		o.MaxValuesPerRequest = 0
+	}
+	if o.client != nil {
+		c = o.client
+	}
+	var sp *spool
+	if o.SpoolDir != "" {
+		p, err := newSpool(o.SpoolDir)
+		if err != nil {
+			return nil, err
+		}
+		sp = p
+	}
+	hc, err := newHostCache(o.HostCacheFile)
+	if err != nil {
+		return nil, err
+	}
+	gc, err := newGraphCache(o.GraphDefCacheFile, o.ForeignGraphDefs)
+	if err != nil {
+		return nil, err
 	}
 
 	// TODO(lufia): Should I use pull.Controller?
 	// see https://github.com/open-telemetry/opentelemetry-go/pull/751
-	return &Exporter{
-		c:               c,
-		opts:            &o,
-		hosts:           make(map[string]string),
-		serviceRoles:    make(map[string]map[string]struct{}),
-		graphDefs:       make(map[string]*mackerel.GraphDefsParam),
-		graphMetricDefs: make(map[string]struct{}),
-	}, nil
+	e := &Exporter{
+		c:    c,
+		opts: &o,
+		backoff: &backoff{
+			min: o.MinBackoff,
+			max: o.MaxBackoff,
+		},
+		queue: &resendQueue{
+			size:   o.MaxQueueSize,
+			maxAge: o.MaxQueueAge,
+		},
+		spool:        sp,
+		limiter:      l,
+		hosts:        make(map[string]*hostEntry),
+		hostCache:    hc,
+		serviceRoles: make(map[string]map[string]struct{}),
+		inflight:     make(map[string]chan struct{}),
+		graphCache:   gc,
+		aborted:      make(chan struct{}),
+	}
+	if sp != nil {
+		e.replaySpool()
+	}
+	return e, nil
 }
 
 // ExportKindFor implements ExportKindSelector.
@@ -188,6 +624,8 @@ func (e *Exporter) ExportKindFor(*metric.Descriptor, aggregation.Kind) export.Ex
 type (
 	registration struct {
 		res      *tag.Resource
+		entity   Entity
+		labels   *label.Set
 		graphDef *mackerel.GraphDefsParam
 		metrics  []*mackerel.MetricValue
 	}
@@ -197,35 +635,95 @@ type (
 )
 
 // Export exports the provide metric record to Mackerel.
+// Each hosts and services are exported independently.
+// If some of them failed, Export returns *ExportError that holds errors for each targets.
 func (e *Exporter) Export(ctx context.Context, a export.CheckpointSet) error {
-	var regs []*registration
-	a.ForEach(e, func(r export.Record) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return ErrShutdown
+	}
+	e.wg.Add(1)
+	e.mu.Unlock()
+	defer e.wg.Done()
+
+	ctx, cancel := e.abortContext(ctx)
+	defer cancel()
+	err := e.export(ctx, a)
+	e.mu.Lock()
+	e.lastErr = err
+	e.mu.Unlock()
+	return err
+}
+
+func (e *Exporter) export(ctx context.Context, a export.CheckpointSet) error {
+	var (
+		regs []*registration
+		errs ExportError
+	)
+	err := a.ForEach(e, func(r export.Record) error {
 		reg, err := e.convertToRegistration(r, r.Resource())
 		if err != nil {
-			return err
+			errs.add(&TargetError{
+				Op:  OpConvertRecord,
+				Err: fmt.Errorf("%s: %w", r.Descriptor().Name(), err),
+			})
+			return nil
 		}
 		regs = append(regs, reg)
 		return nil
 	})
+	if err != nil {
+		errs.merge(OpConvertRecord, err)
+	}
+
+	if err := e.syncHosts(ctx, time.Now()); err != nil {
+		errs.add(&TargetError{Op: OpSyncHosts, Err: err})
+	}
 
 	var (
 		hostMetrics    []*mackerel.HostMetricValue
 		serviceMetrics = make(map[string][]*mackerel.MetricValue)
-		graphDefs      = make(map[string]*mackerel.GraphDefsParam)
+		graphDefs      graphdef.Set
+		failedHosts    = make(map[string]struct{})
+		failedStatuses = make(map[string]struct{})
+		failedServices = make(map[string]struct{})
+		hostRoles      = make(map[string]map[string]*label.Set) // roleFullnames for each customIdentifier
+		hostMetaData   = make(map[string]map[string]interface{})
 	)
 	for _, reg := range regs {
-		switch t := metricType(reg.res); s := t.(type) {
+		switch t := metricType(&reg.entity); s := t.(type) {
 		case customIdentifier:
 			id := string(s)
-			if _, ok := e.hosts[id]; !ok {
-				h, err := e.upsertHost(reg.res)
-				if err != nil {
-					return err
+			if _, ok := failedHosts[id]; ok {
+				continue
+			}
+			hostID, err := e.registerHost(ctx, reg)
+			if err != nil {
+				errs.add(&TargetError{Op: OpUpsertHost, Host: id, Err: err})
+				failedHosts[id] = struct{}{}
+				continue
+			}
+			if _, ok := failedStatuses[id]; !ok && reg.entity.Status != "" {
+				if err := e.syncHostStatus(ctx, id, reg.entity.Status); err != nil {
+					errs.add(&TargetError{Op: OpUpdateHostStatus, Host: id, Err: err})
+					failedStatuses[id] = struct{}{}
+				}
+			}
+			if s := reg.entity.RoleFullname(); s != "" {
+				if hostRoles[id] == nil {
+					hostRoles[id] = make(map[string]*label.Set)
+				}
+				hostRoles[id][s] = reg.labels
+			}
+			if m := e.hostMetaData(reg.labels); len(m) > 0 {
+				if hostMetaData[id] == nil {
+					hostMetaData[id] = make(map[string]interface{})
+				}
+				for k, v := range m {
+					hostMetaData[id][k] = v
 				}
-				e.hosts[id] = h
 			}
-
-			hostID := e.hosts[id]
 			for _, m := range reg.metrics {
 				hostMetrics = append(hostMetrics, &mackerel.HostMetricValue{
 					HostID:      hostID,
@@ -234,74 +732,159 @@ func (e *Exporter) Export(ctx context.Context, a export.CheckpointSet) error {
 			}
 		case serviceName:
 			name := string(s)
-			if err := e.registerService(name); err != nil {
-				return err
+			if _, ok := failedServices[name]; ok {
+				continue
+			}
+			if err := e.registerService(ctx, name, reg.labels); err != nil {
+				errs.add(&TargetError{Op: OpRegisterService, Service: name, Err: err})
+				failedServices[name] = struct{}{}
+				continue
 			}
 			serviceMetrics[name] = append(serviceMetrics[name], reg.metrics...)
 		default:
 			continue
 		}
 
-		if reg.graphDef != nil {
-			for _, m := range reg.graphDef.Metrics {
-				if _, ok := e.graphMetricDefs[m.Name]; ok {
-					// A graph is already registered; not need registration.
-					continue
-				}
-				if g, ok := graphDefs[reg.graphDef.Name]; ok {
-					g.Metrics = append(g.Metrics, m)
-				} else {
-					graphDefs[reg.graphDef.Name] = reg.graphDef
-				}
+		if d := reg.graphDef; d != nil {
+			if err := graphDefs.Add(d); err != nil {
+				errs.add(&TargetError{Op: OpCreateGraphDefs, GraphDef: d.Name, Err: err})
 			}
 		}
 	}
-
-	var defs []*mackerel.GraphDefsParam
-	for _, d := range graphDefs {
-		defs = append(defs, d)
+	for id, roles := range hostRoles {
+		if err := e.syncHostRoles(ctx, id, roles); err != nil {
+			errs.add(&TargetError{Op: OpUpdateHostRoles, Host: id, Err: err})
+		}
 	}
-	if len(defs) > 0 {
-		if err := e.c.CreateGraphDefs(defs); err != nil {
-			return fmt.Errorf("can't create graph-defs: %w", err)
+	for id, m := range hostMetaData {
+		if err := e.syncHostMetaData(ctx, id, m); err != nil {
+			errs.add(&TargetError{Op: OpPutMetaData, Host: id, Err: err})
 		}
-		e.mergeGraphDefs(graphDefs)
 	}
 
-	if len(hostMetrics) > 0 {
-		if err := e.c.PostHostMetricValues(hostMetrics); err != nil {
-			return fmt.Errorf("can't post host metrics: %w", err)
+	if graphDefs.Len() > 0 {
+		if err := e.createGraphDefs(ctx, &graphDefs); err != nil {
+			errs.merge(OpCreateGraphDefs, err)
 		}
 	}
+
+	var batches []*batch
+	now := time.Now()
+	if len(hostMetrics) > 0 {
+		b := &batch{HostMetrics: hostMetrics, Created: now}
+		batches = append(batches, b.split(e.opts.MaxValuesPerRequest)...)
+	}
 	for s, a := range serviceMetrics {
-		if err := e.c.PostServiceMetricValues(s, a); err != nil {
-			return fmt.Errorf("can't post service metrics: %w", err)
+		b := &batch{Service: s, ServiceMetrics: a, Created: now}
+		batches = append(batches, b.split(e.opts.MaxValuesPerRequest)...)
+	}
+	if err := e.send(ctx, batches); err != nil {
+		errs.merge(OpPostHostMetrics, err)
+	}
+	if d := e.opts.RetireAfter; d > 0 {
+		if err := e.retireHosts(ctx, now.Add(-d)); err != nil {
+			errs.merge(OpRetireHost, err)
 		}
 	}
-	return nil
+	e.saveHostCache()
+	e.saveGraphCache()
+	return errs.err()
 }
 
-func metricType(res *tag.Resource) interface{} {
-	if s := res.CustomIdentifier(); s != "" {
-		return customIdentifier(s)
+// Shutdown waits for exports in progress, then it resends metrics that are held in the queue.
+// After Shutdown, Export always returns ErrShutdown.
+// If ctx is done before exports are finished, they will be canceled.
+//
+// Shutdown returns *ExportError that describes metrics the exporter could not deliver;
+// the errors of the last export, and the metrics remaining in the queue that are reported with ErrNotDelivered.
+// The metrics in the spool are not reported because they will be resent by the next process.
+// If WithRetireOnShutdown is set, Shutdown also retires hosts, and reports the errors of the retirement.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
 	}
-	if s := res.ServiceName(); s != "" {
-		return serviceName(s)
+	e.closed = true
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		e.abort()
+		<-done
 	}
-	return nil
-}
 
-func (e *Exporter) mergeGraphDefs(defs map[string]*mackerel.GraphDefsParam) {
-	for k, v := range defs {
-		if p, ok := e.graphDefs[k]; ok {
-			p.Metrics = append(p.Metrics, v.Metrics...)
-		} else {
-			e.graphDefs[k] = v
+	e.mu.Lock()
+	lastErr := e.lastErr
+	e.mu.Unlock()
+
+	var (
+		errs ExportError
+		p    *ExportError
+	)
+	if errors.As(lastErr, &p) {
+		for _, err := range p.Errors {
+			if err.queued() {
+				continue
+			}
+			errs.add(err)
+		}
+	} else if lastErr != nil {
+		errs.merge(OpPostHostMetrics, lastErr)
+	}
+
+	if err := e.resend(ctx); err != nil {
+		for {
+			b := e.queue.pop(time.Now())
+			if b == nil {
+				break
+			}
+			errs.add(b.error(fmt.Errorf("%w: %v", ErrNotDelivered, err)))
 		}
-		for _, m := range v.Metrics {
-			e.graphMetricDefs[m.Name] = struct{}{}
+	}
+	if e.opts.RetireOnShutdown {
+		if err := e.retireHosts(ctx, time.Time{}); err != nil {
+			errs.merge(OpRetireHost, err)
 		}
+		e.saveHostCache()
+	}
+	return errs.err()
+}
+
+// abortContext returns the context that is canceled when the exporter is aborted.
+func (e *Exporter) abortContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-e.aborted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// abort cancels exports in progress.
+func (e *Exporter) abort() {
+	e.abortOnce.Do(func() {
+		close(e.aborted)
+	})
+}
+
+func metricType(ent *Entity) interface{} {
+	if s := ent.CustomIdentifier; s != "" {
+		return customIdentifier(s)
+	}
+	if s := ent.Service; s != "" {
+		return serviceName(s)
 	}
+	return nil
 }
 
 func (e *Exporter) convertToRegistration(r export.Record, res *resource.Resource) (*registration, error) {
@@ -312,25 +895,78 @@ func (e *Exporter) convertToRegistration(r export.Record, res *resource.Resource
 	var t tag.Resource
 	labels := append(r.Labels().ToSlice(), res.Attributes()...)
 	if err := tag.UnmarshalTags(labels, &t); err != nil {
-		return nil, err
+		if e.opts.EntityMapper == nil {
+			return nil, err
+		}
+		// The custom mapper can decide the entity without the resource,
+		// so the record is exported without host specs.
+		t = tag.Resource{}
 	}
+	hostID := t.Host.ID // the mapping might replace it
+	e.opts.ResourceMapping.apply(&t)
 	reg.res = &t
+	set := label.NewSet(labels...)
+	reg.labels = &set
+	if m := e.opts.EntityMapper; m != nil {
+		reg.entity = m.MapEntity(reg.labels)
+	} else {
+		reg.entity = defaultEntity(&t)
+	}
+	if hostID != "" && reg.entity.CustomIdentifier != hostID {
+		// The mapping replaced the instance of the cloud with another host, such as a pod or a container.
+		t.Cloud = tag.Cloud{}
+	}
 
 	// TODO(lufia): Enforce the metric to be the custom metric if hint is exist
+	_, service := metricType(&reg.entity).(serviceName)
+	if e.opts.LegacyServiceMetricNames {
+		service = false
+	}
 	name := metricname.Canonical(desc.Name())
+	if service {
+		// Service metrics don't belong to the custom metrics of hosts.
+		name = metricname.Sanitize(desc.Name())
+	}
 	hint := e.lookupHint(desc.Name())
+	spec := e.lookupGraphSpec(desc.Name(), desc.MetricKind())
 	aggr := r.Aggregation()
-	reg.metrics = e.metricValues(name, aggr, kind)
+	_, scale := graphdef.ConvertUnit(desc.Unit())
+	reg.metrics = e.metricValues(name, aggr, kind, scale)
 
+	if service {
+		// Mackerel don't have Graph Definitions for service metrics.
+		// Instead, it groups service metrics into graphs by the name before the final dot.
+		pattern := hint
+		if spec != nil {
+			pattern = spec.Name
+		}
+		if pattern != "" {
+			pattern = metricname.Sanitize(pattern)
+			for _, m := range reg.metrics {
+				m.Name = metricname.Group(m.Name, pattern)
+			}
+		}
+		return &reg, nil
+	}
 	if !strings.HasPrefix(name, "custom.") {
 		return &reg, nil
 	}
+	if hint != "" {
+		hint = metricname.Canonical(hint)
+	}
 	opts := graphdef.Options{
 		Name:      hint,
 		Unit:      desc.Unit(),
 		Kind:      kind,
 		Quantiles: e.opts.Quantiles,
 	}
+	if spec != nil {
+		opts.Name = metricname.Canonical(spec.Name)
+		opts.DisplayName = spec.DisplayName
+		opts.GraphUnit = spec.Unit
+		opts.Stacked = spec.IsStacked
+		opts.Series = spec.Series
+	}
 	g, err := graphdef.New(name, desc.MetricKind(), opts)
 	if err != nil {
 		return nil, err
@@ -343,23 +979,43 @@ func (e *Exporter) convertToRegistration(r export.Record, res *resource.Resource
 func (e *Exporter) lookupHint(name string) string {
 	for _, s := range e.opts.Hints {
 		if metricname.Match(name, s) {
-			return metricname.Canonical(s)
+			return s
 		}
 	}
 	return ""
 }
 
-func (e *Exporter) metricValues(name string, aggr aggregation.Aggregation, kind metric.NumberKind) []*mackerel.MetricValue {
+// lookupGraphSpec returns the spec of the Graph Definition that matches name.
+func (e *Exporter) lookupGraphSpec(name string, kind metric.Kind) *GraphSpec {
+	if kind == metric.ValueRecorderKind {
+		name = metricname.Join(name, "max") // same as graphdef.New
+	}
+	for i, spec := range e.opts.GraphDefs {
+		if metricname.Match(name, metricname.Join(spec.Name, "*")) {
+			return &e.opts.GraphDefs[i]
+		}
+	}
+	return nil
+}
+
+// metricValues returns values of aggr. Each values are multiplied by scale to be in Mackerel's unit.
+func (e *Exporter) metricValues(name string, aggr aggregation.Aggregation, kind metric.NumberKind, scale float64) []*mackerel.MetricValue {
 	var a []*mackerel.MetricValue
+	value := func(n metric.Number) interface{} {
+		if scale == 1 {
+			return n.AsInterface(kind)
+		}
+		return n.CoerceToFloat64(kind) * scale
+	}
 
 	// see https://github.com/open-telemetry/opentelemetry-go/blob/master/sdk/metric/selector/simple/simple.go
 	if p, ok := aggr.(aggregation.Distribution); ok {
 		// metric.Value{Record|Obserb}erKind: MinMaxSumCount, Distribution, Points
 		if min, err := p.Min(); err == nil {
-			a = append(a, metricValue(metricname.Join(name, "min"), min.AsInterface(kind)))
+			a = append(a, metricValue(metricname.Join(name, "min"), value(min)))
 		}
 		if max, err := p.Max(); err == nil {
-			a = append(a, metricValue(metricname.Join(name, "max"), max.AsInterface(kind)))
+			a = append(a, metricValue(metricname.Join(name, "max"), value(max)))
 		}
 		for _, quantile := range e.opts.Quantiles {
 			q, err := p.Quantile(quantile)
@@ -367,17 +1023,17 @@ func (e *Exporter) metricValues(name string, aggr aggregation.Aggregation, kind
 				continue
 			}
 			qname := metricname.Percentile(quantile)
-			a = append(a, metricValue(metricname.Join(name, qname), q.AsInterface(kind)))
+			a = append(a, metricValue(metricname.Join(name, qname), value(q)))
 		}
 	} else if p, ok := aggr.(aggregation.LastValue); ok {
 		// Where this aggregator is used in?
 		if last, _, err := p.LastValue(); err == nil {
-			a = append(a, metricValue(name, last.AsInterface(kind)))
+			a = append(a, metricValue(name, value(last)))
 		}
 	} else if p, ok := aggr.(aggregation.Sum); ok {
 		// metric.CounterKind, etc: Sum
 		if sum, err := p.Sum(); err == nil {
-			a = append(a, metricValue(name, sum.AsInterface(kind)))
+			a = append(a, metricValue(name, value(sum)))
 		}
 	}
 	return a
@@ -391,6 +1047,15 @@ func metricValue(name string, v interface{}) *mackerel.MetricValue {
 	}
 }
 
+// ThrottleState returns the state of the client-side rate limiter.
+// It always returns zero value in the pull mode.
+func (e *Exporter) ThrottleState() ThrottleState {
+	if e.limiter == nil {
+		return ThrottleState{}
+	}
+	return e.limiter.state(time.Now())
+}
+
 func (e *Exporter) Handler() http.Handler {
 	h, _ := e.c.(http.Handler)
 	return h
@@ -0,0 +1,440 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/api/metric"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/sdk/export/metric/metrictest"
+	"go.opentelemetry.io/otel/sdk/metric/aggregator/sum"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/unit"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+type testRecord struct {
+	name   string
+	value  int64
+	labels []label.KeyValue
+}
+
+func newCheckpointSet(t *testing.T, records ...testRecord) *metrictest.CheckpointSet {
+	t.Helper()
+	ctx := context.Background()
+	cs := metrictest.NewCheckpointSet(resource.New())
+	for _, r := range records {
+		desc := metric.NewDescriptor(r.name, metric.CounterKind, metric.Int64NumberKind)
+		agg := &sum.New(1)[0]
+		if err := agg.Update(ctx, metric.NewInt64Number(r.value), &desc); err != nil {
+			t.Fatal(err)
+		}
+		cs.Add(&desc, agg, r.labels...)
+	}
+	return cs
+}
+
+// brokenClient fails the API calls for specific hosts or services.
+type brokenClient struct {
+	handlerClient
+	brokenHosts    map[string]bool
+	brokenServices map[string]bool
+
+	mu             sync.Mutex
+	hostMetrics    []*mackerel.HostMetricValue
+	serviceMetrics map[string][]*mackerel.MetricValue
+}
+
+var errBroken = errors.New("broken")
+
+func (c *brokenClient) CreateHost(ctx context.Context, param *mackerel.CreateHostParam) (string, error) {
+	if c.brokenHosts[param.CustomIdentifier] {
+		return "", errBroken
+	}
+	return c.handlerClient.CreateHost(ctx, param)
+}
+
+func (c *brokenClient) PostHostMetricValues(ctx context.Context, metrics []*mackerel.HostMetricValue) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hostMetrics = append(c.hostMetrics, metrics...)
+	return nil
+}
+
+func (c *brokenClient) PostServiceMetricValues(ctx context.Context, name string, metrics []*mackerel.MetricValue) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.brokenServices[name] {
+		return errBroken
+	}
+	if c.serviceMetrics == nil {
+		c.serviceMetrics = make(map[string][]*mackerel.MetricValue)
+	}
+	c.serviceMetrics[name] = append(c.serviceMetrics[name], metrics...)
+	return nil
+}
+
+func TestExportIsolatesTargets(t *testing.T) {
+	c := &brokenClient{
+		brokenHosts:    map[string]bool{"bad-host": true},
+		brokenServices: map[string]bool{"bad-service": true},
+	}
+	e := newTestExporter(t, c, WithMaxRetries(0))
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{KeyHostID.String("good-host")}},
+		testRecord{"requests", 2, []label.KeyValue{KeyHostID.String("bad-host")}},
+		testRecord{"errors", 3, []label.KeyValue{KeyServiceNS.String("good-service")}},
+		testRecord{"errors", 4, []label.KeyValue{KeyServiceNS.String("bad-service")}},
+	)
+	err := e.Export(context.Background(), cs)
+	var p *ExportError
+	if !errors.As(err, &p) {
+		t.Fatalf("Export() = %v; want *ExportError", err)
+	}
+	if n := len(p.Errors); n != 2 {
+		t.Fatalf("len(Errors) = %d; want 2: %v", n, err)
+	}
+	for _, err := range p.Errors {
+		switch {
+		case err.Op == OpUpsertHost && err.Host == "bad-host":
+		case err.Op == OpPostServiceMetrics && err.Service == "bad-service":
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !errors.Is(err, errBroken) {
+			t.Errorf("%v is not %v", err, errBroken)
+		}
+	}
+
+	if n := len(c.hostMetrics); n != 1 || c.hostMetrics[0].Value != int64(1) {
+		t.Errorf("hostMetrics = %v; want only the value of good-host", c.hostMetrics)
+	}
+	if n := len(c.serviceMetrics["good-service"]); n != 1 {
+		t.Errorf("len(serviceMetrics[good-service]) = %d; want 1", n)
+	}
+}
+
+func TestExportCanceled(t *testing.T) {
+	c := &brokenClient{}
+	e := newTestExporter(t, c)
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{KeyServiceNS.String("service")}},
+	)
+	e.serviceRoles["service"] = make(map[string]struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := e.Export(ctx, cs)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Export() = %v; want %v", err, context.Canceled)
+	}
+	if n := len(c.serviceMetrics); n != 0 {
+		t.Errorf("len(serviceMetrics) = %d; want 0", n)
+	}
+	if n := len(e.queue.a); n != 1 {
+		t.Errorf("len(queue) = %d; want 1", n)
+	}
+}
+
+func TestExporterShutdown(t *testing.T) {
+	ctx := context.Background()
+	c := &flakyClient{fails: 1}
+	e := newTestExporter(t, c, WithMaxRetries(0))
+	if err := e.send(ctx, []*batch{hostBatch("custom.a", time.Now())}); err == nil {
+		t.Fatal("send() = nil; want an error")
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if n := len(c.posted); n != 1 {
+		t.Errorf("len(posted) = %d; want 1", n)
+	}
+	if err := e.Export(ctx, newCheckpointSet(t)); err != ErrShutdown {
+		t.Errorf("Export() = %v; want %v", err, ErrShutdown)
+	}
+}
+
+func TestExporterShutdownNotDelivered(t *testing.T) {
+	ctx := context.Background()
+	c := &flakyClient{bad: "custom.a"}
+	e := newTestExporter(t, c, WithMaxRetries(0))
+	if err := e.send(ctx, []*batch{hostBatch("custom.a", time.Now())}); err == nil {
+		t.Fatal("send() = nil; want an error")
+	}
+	err := e.Shutdown(ctx)
+	if !errors.Is(err, ErrNotDelivered) {
+		t.Fatalf("Shutdown() = %v; want %v", err, ErrNotDelivered)
+	}
+	var p *ExportError
+	if !errors.As(err, &p) || len(p.Errors) != 1 || p.Errors[0].Op != OpPostHostMetrics {
+		t.Errorf("Shutdown() = %v; want an error of host metrics", err)
+	}
+}
+
+func TestPipelineShutdown(t *testing.T) {
+	pusher, handler, err := NewExportPipeline(
+		WithResource(KeyHostID.String("1-2-3-4")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	meter := pusher.MeterProvider().Meter("test")
+	counter := metric.Must(meter).NewInt64Counter("requests")
+	counter.Add(ctx, 10)
+	if err := pusher.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+	if s := w.Body.String(); !strings.HasPrefix(s, "requests\t10\t") {
+		t.Errorf("Body = %q; want requests", s)
+	}
+}
+
+func TestExporterConcurrentExport(t *testing.T) {
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := e.c.(*handlerClient)
+
+	const n = 8
+	sets := make([]*metrictest.CheckpointSet, n)
+	for i := range sets {
+		var records []testRecord
+		for j := 0; j < 5; j++ {
+			records = append(records,
+				testRecord{"requests", int64(i), []label.KeyValue{
+					KeyHostID.String(fmt.Sprintf("host-%d", j)),
+					KeyServiceNS.String("service"),
+					KeyServiceName.String(fmt.Sprintf("role-%d", j%2)),
+				}},
+				testRecord{"errors", int64(i), []label.KeyValue{
+					KeyServiceNS.String(fmt.Sprintf("service-%d", j)),
+				}},
+			)
+		}
+		sets[i] = newCheckpointSet(t, records...)
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = e.Export(ctx, sets[i])
+		}(i)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			e.Handler().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Export(%d) = %v", i, err)
+		}
+	}
+	if n := len(c.hosts); n != 5 {
+		t.Errorf("len(hosts) = %d; want 5", n)
+	}
+	if n := len(c.services); n != 6 {
+		t.Errorf("len(services) = %d; want 6", n)
+	}
+}
+
+// graphDefClient records Graph Definitions that are created.
+type graphDefClient struct {
+	handlerClient
+	graphDefs []*mackerel.GraphDefsParam
+}
+
+func (c *graphDefClient) CreateGraphDefs(ctx context.Context, defs []*mackerel.GraphDefsParam) error {
+	c.graphDefs = append(c.graphDefs, defs...)
+	return nil
+}
+
+func TestExportWithGraphDefs(t *testing.T) {
+	c := &graphDefClient{}
+	e := newTestExporter(t, c,
+		WithHints([]string{"http.#"}),
+		WithGraphDefs([]GraphSpec{
+			{
+				Name:        "http",
+				DisplayName: "HTTP requests",
+				Unit:        "percentage",
+				IsStacked:   true,
+				Series:      map[string]string{"requests": "Requests"},
+			},
+		}),
+	)
+	cs := newCheckpointSet(t,
+		testRecord{"http.requests", 1, []label.KeyValue{KeyHostID.String("1-2-3-4")}},
+	)
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.graphDefs); n != 1 {
+		t.Fatalf("len(graphDefs) = %d; want 1", n)
+	}
+	g := c.graphDefs[0]
+	if g.Name != "custom.http" || g.DisplayName != "HTTP requests" || g.Unit != "percentage" {
+		t.Errorf("graphDef = {%s %s %s}; want {custom.http HTTP requests percentage}", g.Name, g.DisplayName, g.Unit)
+	}
+	want := []*mackerel.GraphDefsMetric{
+		{Name: "custom.http.requests", DisplayName: "Requests", IsStacked: true},
+	}
+	if !reflect.DeepEqual(g.Metrics, want) {
+		t.Errorf("Metrics = %v; want %v", g.Metrics, want)
+	}
+}
+
+func TestMetricValuesScale(t *testing.T) {
+	ctx := context.Background()
+	desc := metric.NewDescriptor("latency", metric.CounterKind, metric.Int64NumberKind)
+	agg := &sum.New(1)[0]
+	if err := agg.Update(ctx, metric.NewInt64Number(1500000), &desc); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExporter(t, &handlerClient{})
+	tests := []struct {
+		scale float64
+		want  interface{}
+	}{
+		{1, int64(1500000)},
+		{1e-6, 1.5},
+	}
+	for _, tt := range tests {
+		a := e.metricValues("custom.latency", agg, metric.Int64NumberKind, tt.scale)
+		if len(a) != 1 || a[0].Value != tt.want {
+			t.Errorf("metricValues(scale=%v) = %v; want %v", tt.scale, a, tt.want)
+		}
+	}
+}
+
+func TestExportMergesGraphDefs(t *testing.T) {
+	c := &graphDefClient{}
+	e := newTestExporter(t, c, WithGraphDefs([]GraphSpec{
+		{Name: "http", Series: map[string]string{"requests": "Requests"}},
+	}))
+	host := KeyHostID.String("1-2-3-4")
+	cs := newCheckpointSet(t,
+		testRecord{"http.requests", 1, []label.KeyValue{host}},
+		testRecord{"http.requests", 1, []label.KeyValue{host, label.String("path", "/")}},
+		testRecord{"http.errors", 1, []label.KeyValue{host}},
+	)
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.graphDefs); n != 1 {
+		t.Fatalf("len(graphDefs) = %d; want 1", n)
+	}
+	want := map[string]string{
+		"custom.http.requests": "Requests",
+		"custom.http.*":        "%1",
+	}
+	got := make(map[string]string)
+	for _, m := range c.graphDefs[0].Metrics {
+		if _, ok := got[m.Name]; ok {
+			t.Errorf("metric %s is duplicated", m.Name)
+		}
+		got[m.Name] = m.DisplayName
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Metrics = %v; want %v", got, want)
+	}
+}
+
+func TestExportGraphDefConflict(t *testing.T) {
+	c := &graphDefClient{}
+	e := newTestExporter(t, c)
+	host := KeyHostID.String("1-2-3-4")
+	cs := metrictest.NewCheckpointSet(resource.New())
+	for _, u := range []unit.Unit{unit.Bytes, unit.Milliseconds} {
+		desc := metric.NewDescriptor("http."+string(u), metric.CounterKind, metric.Int64NumberKind, metric.WithUnit(u))
+		agg := &sum.New(1)[0]
+		if err := agg.Update(context.Background(), metric.NewInt64Number(1), &desc); err != nil {
+			t.Fatal(err)
+		}
+		cs.Add(&desc, agg, host)
+	}
+	err := e.Export(context.Background(), cs)
+	var p *GraphDefConflictError
+	if !errors.As(err, &p) {
+		t.Fatalf("Export() = %v; want *GraphDefConflictError", err)
+	}
+	if n := len(c.graphDefs); n != 1 {
+		t.Errorf("len(graphDefs) = %d; want 1", n)
+	}
+}
+
+func TestExportServiceMetricNames(t *testing.T) {
+	c := &brokenClient{}
+	e := newTestExporter(t, c, WithGraphDefs([]GraphSpec{
+		{Name: "http.*"},
+	}))
+	service := KeyServiceNS.String("service")
+	cs := newCheckpointSet(t,
+		testRecord{"http.index.count", 1, []label.KeyValue{service}},
+		testRecord{"queue.size", 1, []label.KeyValue{service}},
+	)
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	var names []string
+	for _, m := range c.serviceMetrics["service"] {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"http.index_count", "queue.size"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("service metrics = %v; want %v", names, want)
+	}
+}
+
+func TestNewExporterInvalidPeriod(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Minute} {
+		if _, err := NewExporter(WithPeriod(d)); err == nil {
+			t.Errorf("NewExporter(WithPeriod(%v)) = nil; want an error", d)
+		}
+		if _, _, err := NewExportPipeline(WithPeriod(d)); err == nil {
+			t.Errorf("NewExportPipeline(WithPeriod(%v)) = nil; want an error", d)
+		}
+	}
+}
+
+func TestExportLegacyServiceMetricNames(t *testing.T) {
+	c := &brokenClient{}
+	e := newTestExporter(t, c, WithLegacyServiceMetricNames(), WithGraphDefs([]GraphSpec{
+		{Name: "http.*"},
+	}))
+	service := KeyServiceNS.String("service")
+	cs := newCheckpointSet(t,
+		testRecord{"http.index.count", 1, []label.KeyValue{service}},
+		testRecord{"queue.size", 1, []label.KeyValue{service}},
+	)
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	var names []string
+	for _, m := range c.serviceMetrics["service"] {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"custom.http.index.count", "custom.queue.size"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("service metrics = %v; want %v", names, want)
+	}
+}
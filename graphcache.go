@@ -0,0 +1,195 @@
+package mackerel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"go.opentelemetry.io/otel/api/global"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/graphdef"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// GraphDefPolicy decides whether the exporter overwrites Graph Definitions that already exist in Mackerel.
+type GraphDefPolicy int
+
+const (
+	// GraphDefOverwrite overwrites Graph Definitions whenever generated ones are changed.
+	GraphDefOverwrite GraphDefPolicy = iota
+
+	// GraphDefOverwriteOwned overwrites only Graph Definitions that the exporter has created.
+	GraphDefOverwriteOwned
+
+	// GraphDefKeep never overwrites Graph Definitions that already exist.
+	GraphDefKeep
+)
+
+// graphDefEntry is a Graph Definition in the cache file.
+type graphDefEntry struct {
+	Def   *mackerel.GraphDefsParam `json:"def"`
+	Owned bool                     `json:"owned"` // whether the exporter created the definition
+}
+
+// graphCache records Graph Definitions that exist in Mackerel.
+// Mackerel API can't list Graph Definitions, so the exporter remembers what it has posted.
+type graphCache struct {
+	file    string // if it is not empty, the cache is persisted to the file
+	reg     graphdef.Registry
+	owned   map[string]bool
+	foreign map[string]struct{} // names of definitions that are created by others
+	dirty   bool                // reg is changed since the last save
+}
+
+func newGraphCache(file string, foreign []string) (*graphCache, error) {
+	c := &graphCache{
+		file:    file,
+		owned:   make(map[string]bool),
+		foreign: make(map[string]struct{}),
+	}
+	for _, name := range foreign {
+		c.foreign[name] = struct{}{}
+	}
+	if file == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]*graphDefEntry
+	if err := json.Unmarshal(data, &m); err != nil {
+		global.Handle(fmt.Errorf("ignore the graph cache %s: %w", file, err))
+		return c, nil
+	}
+	for name, p := range m {
+		if p == nil || p.Def == nil || p.Def.Name != name {
+			continue
+		}
+		c.reg.Register(p.Def)
+		c.owned[name] = p.Owned
+	}
+	return c, nil
+}
+
+// marshal returns the content of the file if the cache is changed since the last call.
+// It returns nil if the cache don't have to be saved.
+func (c *graphCache) marshal() ([]byte, error) {
+	if c.file == "" || !c.dirty {
+		return nil, nil
+	}
+	m := make(map[string]*graphDefEntry)
+	for _, d := range c.reg.Defs() {
+		m[d.Name] = &graphDefEntry{Def: d, Owned: c.owned[d.Name]}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	c.dirty = false
+	return data, nil
+}
+
+// changes returns definitions that should be posted to reflect s according to policy.
+func (c *graphCache) changes(s *graphdef.Set, policy GraphDefPolicy) []*mackerel.GraphDefsParam {
+	var a []*mackerel.GraphDefsParam
+	for _, d := range c.reg.Changes(s) {
+		if !c.writable(d.Name, policy) {
+			continue
+		}
+		a = append(a, d)
+	}
+	return a
+}
+
+// writable reports whether the exporter can post the definition of name according to policy.
+func (c *graphCache) writable(name string, policy GraphDefPolicy) bool {
+	if policy == GraphDefOverwrite {
+		return true
+	}
+	if _, ok := c.reg.Lookup(name); ok {
+		return policy == GraphDefOverwriteOwned && c.owned[name]
+	}
+	_, foreign := c.foreign[name]
+	return !foreign
+}
+
+// set records that d is posted.
+func (c *graphCache) set(d *mackerel.GraphDefsParam) {
+	if _, ok := c.reg.Lookup(d.Name); !ok {
+		_, foreign := c.foreign[d.Name]
+		c.owned[d.Name] = !foreign
+	}
+	c.reg.Register(d)
+	c.dirty = true
+}
+
+// graphDefChanges returns definitions in s that should be posted.
+func (e *Exporter) graphDefChanges(s *graphdef.Set) []*mackerel.GraphDefsParam {
+	e.graphMu.Lock()
+	defer e.graphMu.Unlock()
+	return e.graphCache.changes(s, e.opts.GraphDefPolicy)
+}
+
+// setGraphDefs records that defs are posted.
+func (e *Exporter) setGraphDefs(defs ...*mackerel.GraphDefsParam) {
+	e.graphMu.Lock()
+	defer e.graphMu.Unlock()
+	for _, d := range defs {
+		e.graphCache.set(d)
+	}
+}
+
+// saveGraphCache saves the graph cache, and reports the error to the global error handler
+// because the cache is only an optimization.
+// The file is written without holding e.graphMu.
+func (e *Exporter) saveGraphCache() {
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+	e.graphMu.Lock()
+	data, err := e.graphCache.marshal()
+	e.graphMu.Unlock()
+	if err == nil && data != nil {
+		if err = writeFile(e.graphCache.file, data); err != nil {
+			e.graphMu.Lock()
+			e.graphCache.dirty = true
+			e.graphMu.Unlock()
+		}
+	}
+	if err != nil {
+		global.Handle(fmt.Errorf("can't save the graph cache: %w", err))
+	}
+}
+
+// createGraphDefs creates graph definitions that are changed at once.
+// If it failed, createGraphDefs retries to create each graph definitions one by one
+// so that a bad graph definition don't block others.
+func (e *Exporter) createGraphDefs(ctx context.Context, graphDefs *graphdef.Set) error {
+	defs := e.graphDefChanges(graphDefs)
+	if len(defs) == 0 {
+		return nil
+	}
+	err := e.c.CreateGraphDefs(ctx, defs)
+	if err == nil {
+		e.setGraphDefs(defs...)
+		return nil
+	}
+	if len(defs) == 1 {
+		return &TargetError{Op: OpCreateGraphDefs, GraphDef: defs[0].Name, Err: err}
+	}
+
+	var errs ExportError
+	for _, d := range defs {
+		if err := e.c.CreateGraphDefs(ctx, []*mackerel.GraphDefsParam{d}); err != nil {
+			errs.add(&TargetError{Op: OpCreateGraphDefs, GraphDef: d.Name, Err: err})
+			continue
+		}
+		e.setGraphDefs(d)
+	}
+	return errs.err()
+}
@@ -0,0 +1,166 @@
+package mackerel
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/graphdef"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func testGraphDef(name, displayName string, metrics ...string) *mackerel.GraphDefsParam {
+	g := &mackerel.GraphDefsParam{
+		Name:        name,
+		DisplayName: displayName,
+		Unit:        "integer",
+	}
+	for _, s := range metrics {
+		g.Metrics = append(g.Metrics, &mackerel.GraphDefsMetric{Name: s})
+	}
+	return g
+}
+
+func TestGraphCacheChanges(t *testing.T) {
+	tests := []struct {
+		desc   string
+		policy GraphDefPolicy
+		def    *mackerel.GraphDefsParam
+		want   *mackerel.GraphDefsParam
+	}{
+		{
+			desc:   "unchanged",
+			policy: GraphDefOverwrite,
+			def:    testGraphDef("custom.owned", "owned", "custom.owned.a"),
+			want:   nil,
+		},
+		{
+			desc:   "new_metric",
+			policy: GraphDefOverwrite,
+			def:    testGraphDef("custom.owned", "owned", "custom.owned.b"),
+			want:   testGraphDef("custom.owned", "owned", "custom.owned.a", "custom.owned.b"),
+		},
+		{
+			desc:   "new_graph",
+			policy: GraphDefKeep,
+			def:    testGraphDef("custom.new", "new", "custom.new.a", "custom.new.a"),
+			want:   testGraphDef("custom.new", "new", "custom.new.a"),
+		},
+		{
+			desc:   "keep_changed",
+			policy: GraphDefKeep,
+			def:    testGraphDef("custom.owned", "changed", "custom.owned.a"),
+			want:   nil,
+		},
+		{
+			desc:   "overwrite_owned",
+			policy: GraphDefOverwriteOwned,
+			def:    testGraphDef("custom.owned", "changed", "custom.owned.a"),
+			want:   testGraphDef("custom.owned", "changed", "custom.owned.a"),
+		},
+		{
+			desc:   "overwrite_owned_but_not_owned",
+			policy: GraphDefOverwriteOwned,
+			def:    testGraphDef("custom.adopted", "changed", "custom.adopted.a"),
+			want:   nil,
+		},
+		{
+			desc:   "overwrite_owned_but_foreign",
+			policy: GraphDefOverwriteOwned,
+			def:    testGraphDef("custom.foreign", "foreign", "custom.foreign.a"),
+			want:   nil,
+		},
+		{
+			desc:   "overwrite_foreign",
+			policy: GraphDefOverwrite,
+			def:    testGraphDef("custom.foreign", "foreign", "custom.foreign.a"),
+			want:   testGraphDef("custom.foreign", "foreign", "custom.foreign.a"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			c, err := newGraphCache("", []string{"custom.foreign"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.set(testGraphDef("custom.owned", "owned", "custom.owned.a"))
+			c.reg.Register(testGraphDef("custom.adopted", "adopted", "custom.adopted.a"))
+
+			var s graphdef.Set
+			if err := s.Add(tt.def); err != nil {
+				t.Fatal(err)
+			}
+			var want []*mackerel.GraphDefsParam
+			if tt.want != nil {
+				want = append(want, tt.want)
+			}
+			if a := c.changes(&s, tt.policy); !reflect.DeepEqual(a, want) {
+				t.Errorf("changes(%s) = %v; want %v", tt.def.Name, a, want)
+			}
+		})
+	}
+}
+
+func TestExporterGraphDefCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "graphs.json")
+
+	ctx := context.Background()
+	records := func(names ...string) []testRecord {
+		var a []testRecord
+		for _, name := range names {
+			a = append(a, testRecord{name, 1, []label.KeyValue{KeyHostID.String("1-2-3-4")}})
+		}
+		return a
+	}
+	c := &graphDefClient{}
+	e := newTestExporter(t, c, WithGraphDefCacheFile(file))
+	if err := e.Export(ctx, newCheckpointSet(t, records("http.requests", "http.errors")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.graphDefs); n != 1 {
+		t.Fatalf("len(graphDefs) = %d; want 1", n)
+	}
+	if n := len(c.graphDefs[0].Metrics); n != 1 {
+		t.Errorf("len(Metrics) = %d; want 1", n)
+	}
+
+	c.graphDefs = nil
+	e = newTestExporter(t, c, WithGraphDefCacheFile(file))
+	if err := e.Export(ctx, newCheckpointSet(t, records("http.requests")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.graphDefs); n != 0 {
+		t.Errorf("len(graphDefs) = %d after the restart; want 0", n)
+	}
+
+	e = newTestExporter(t, c, WithGraphDefCacheFile(file), WithGraphDefPolicy(GraphDefKeep), WithGraphDefs([]GraphSpec{
+		{Name: "http", DisplayName: "HTTP"},
+	}))
+	if err := e.Export(ctx, newCheckpointSet(t, records("http.requests")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.graphDefs); n != 0 {
+		t.Errorf("len(graphDefs) = %d with GraphDefKeep; want 0", n)
+	}
+}
+
+func TestNewExporterGraphDefPolicyWithoutCache(t *testing.T) {
+	for _, p := range []GraphDefPolicy{GraphDefOverwriteOwned, GraphDefKeep} {
+		if _, err := NewExporter(WithGraphDefPolicy(p)); err == nil {
+			t.Errorf("NewExporter(WithGraphDefPolicy(%d)) = nil; want an error", p)
+		}
+	}
+	if _, err := NewExporter(WithGraphDefPolicy(GraphDefOverwrite)); err != nil {
+		t.Errorf("NewExporter(WithGraphDefPolicy(GraphDefOverwrite)) = %v", err)
+	}
+}
@@ -1,10 +1,12 @@
 package mackerel
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"text/template"
 
@@ -12,17 +14,19 @@ import (
 )
 
 type handlerClient struct {
+	mu       sync.RWMutex // guards all fields below
 	services map[string]*mackerel.Service
 	roles    map[string]map[string]*mackerel.Role
 	hosts    map[string]*mackerel.Host
-
-	mu       sync.RWMutex
+	metadata map[string]interface{} // key is the path of the metadata, such as "services/<service>/<namespace>"
 	snapshot []*mackerel.HostMetricValue
 }
 
 var _ http.Handler = &handlerClient{}
 
-func (c *handlerClient) FindServices() ([]*mackerel.Service, error) {
+func (c *handlerClient) FindServices(ctx context.Context) ([]*mackerel.Service, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if len(c.services) == 0 {
 		return nil, nil
 	}
@@ -33,7 +37,9 @@ func (c *handlerClient) FindServices() ([]*mackerel.Service, error) {
 	return a, nil
 }
 
-func (c *handlerClient) CreateService(param *mackerel.CreateServiceParam) (*mackerel.Service, error) {
+func (c *handlerClient) CreateService(ctx context.Context, param *mackerel.CreateServiceParam) (*mackerel.Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if _, ok := c.services[param.Name]; ok {
 		return nil, errors.New("the service already exists")
 	}
@@ -48,7 +54,9 @@ func (c *handlerClient) CreateService(param *mackerel.CreateServiceParam) (*mack
 	return s, nil
 }
 
-func (c *handlerClient) FindRoles(serviceName string) ([]*mackerel.Role, error) {
+func (c *handlerClient) FindRoles(ctx context.Context, serviceName string) ([]*mackerel.Role, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	m := c.roles[serviceName]
 	a := make([]*mackerel.Role, 0, len(m))
 	for _, r := range m {
@@ -57,7 +65,9 @@ func (c *handlerClient) FindRoles(serviceName string) ([]*mackerel.Role, error)
 	return a, nil
 }
 
-func (c *handlerClient) CreateRole(serviceName string, param *mackerel.CreateRoleParam) (*mackerel.Role, error) {
+func (c *handlerClient) CreateRole(ctx context.Context, serviceName string, param *mackerel.CreateRoleParam) (*mackerel.Role, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	m, ok := c.roles[serviceName]
 	if !ok {
 		m = make(map[string]*mackerel.Role)
@@ -77,17 +87,46 @@ func (c *handlerClient) CreateRole(serviceName string, param *mackerel.CreateRol
 	return r, nil
 }
 
-func (c *handlerClient) FindHosts(param *mackerel.FindHostsParam) ([]*mackerel.Host, error) {
-	// BUG(lufia): currently, FindHosts supports seraching by CustomIdentifier only.
+func (c *handlerClient) FindHosts(ctx context.Context, param *mackerel.FindHostsParam) ([]*mackerel.Host, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	// BUG(lufia): currently, FindHosts supports seraching by CustomIdentifier, Service and Roles only.
+	var a []*mackerel.Host
 	for _, h := range c.hosts {
-		if h.CustomIdentifier == param.CustomIdentifier {
-			return []*mackerel.Host{h}, nil
+		if h.IsRetired {
+			continue
+		}
+		if param.CustomIdentifier != "" && h.CustomIdentifier != param.CustomIdentifier {
+			continue
+		}
+		if param.Service != "" && !hasRoles(h.Roles[param.Service], param.Roles) {
+			continue
+		}
+		p := *h
+		a = append(a, &p)
+	}
+	return a, nil
+}
+
+// hasRoles reports whether roles contains any of want.
+// If want is empty, it reports whether roles is not empty.
+func hasRoles(roles, want []string) bool {
+	if len(want) == 0 {
+		return len(roles) > 0
+	}
+	for _, r := range roles {
+		for _, s := range want {
+			if r == s {
+				return true
+			}
 		}
 	}
-	return nil, nil
+	return false
 }
 
-func (c *handlerClient) CreateHost(param *mackerel.CreateHostParam) (string, error) {
+func (c *handlerClient) CreateHost(ctx context.Context, param *mackerel.CreateHostParam) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	id := fmt.Sprintf("%d", len(c.hosts)+1)
 	h := &mackerel.Host{
 		ID:               id,
@@ -96,7 +135,7 @@ func (c *handlerClient) CreateHost(param *mackerel.CreateHostParam) (string, err
 		CustomIdentifier: param.CustomIdentifier,
 		Meta:             param.Meta,
 		Interfaces:       param.Interfaces,
-		// Roles: meta.RoleFullnames
+		Roles:            roles(param.RoleFullnames),
 	}
 	if c.hosts == nil {
 		c.hosts = make(map[string]*mackerel.Host)
@@ -105,7 +144,9 @@ func (c *handlerClient) CreateHost(param *mackerel.CreateHostParam) (string, err
 	return id, nil
 }
 
-func (c *handlerClient) UpdateHost(hostID string, param *mackerel.UpdateHostParam) (string, error) {
+func (c *handlerClient) UpdateHost(ctx context.Context, hostID string, param *mackerel.UpdateHostParam) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	h, ok := c.hosts[hostID]
 	if !ok {
 		return "", errors.New("the host is not exist")
@@ -115,22 +156,95 @@ func (c *handlerClient) UpdateHost(hostID string, param *mackerel.UpdateHostPara
 	h.CustomIdentifier = param.CustomIdentifier
 	h.Meta = param.Meta
 	h.Interfaces = param.Interfaces
-	// h.Roles = param.RoleFullnames
+	h.Roles = roles(param.RoleFullnames)
 	return h.ID, nil
 }
 
-func (c *handlerClient) CreateGraphDefs(defs []*mackerel.GraphDefsParam) error {
+func (c *handlerClient) RetireHost(ctx context.Context, hostID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[hostID]
+	if !ok {
+		return errors.New("the host is not exist")
+	}
+	h.IsRetired = true
+	return nil
+}
+
+func (c *handlerClient) UpdateHostStatus(ctx context.Context, hostID, status string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[hostID]
+	if !ok {
+		return errors.New("the host is not exist")
+	}
+	h.Status = status
+	return nil
+}
+
+func (c *handlerClient) UpdateHostRoleFullnames(ctx context.Context, hostID string, roleFullnames []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[hostID]
+	if !ok {
+		return errors.New("the host is not exist")
+	}
+	h.Roles = roles(roleFullnames)
+	return nil
+}
+
+// roles converts roleFullnames to mackerel.Roles.
+func roles(roleFullnames []string) mackerel.Roles {
+	if len(roleFullnames) == 0 {
+		return nil
+	}
+	m := make(mackerel.Roles)
+	for _, s := range roleFullnames {
+		a := strings.SplitN(s, ":", 2)
+		if len(a) != 2 {
+			continue
+		}
+		m[a[0]] = append(m[a[0]], a[1])
+	}
+	return m
+}
+
+func (c *handlerClient) PutServiceMetaData(ctx context.Context, serviceName, namespace string, v interface{}) error {
+	c.putMetaData("services/"+serviceName+"/"+namespace, v)
+	return nil
+}
+
+func (c *handlerClient) PutRoleMetaData(ctx context.Context, serviceName, roleName, namespace string, v interface{}) error {
+	c.putMetaData("services/"+serviceName+"/roles/"+roleName+"/"+namespace, v)
+	return nil
+}
+
+func (c *handlerClient) PutHostMetaData(ctx context.Context, hostID, namespace string, v interface{}) error {
+	c.putMetaData("hosts/"+hostID+"/"+namespace, v)
+	return nil
+}
+
+func (c *handlerClient) putMetaData(path string, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metadata == nil {
+		c.metadata = make(map[string]interface{})
+	}
+	c.metadata[path] = v
+}
+
+func (c *handlerClient) CreateGraphDefs(ctx context.Context, defs []*mackerel.GraphDefsParam) error {
 	return nil
 }
 
-func (c *handlerClient) PostHostMetricValues(metrics []*mackerel.HostMetricValue) error {
+func (c *handlerClient) PostHostMetricValues(ctx context.Context, metrics []*mackerel.HostMetricValue) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.snapshot = metrics
 	return nil
 }
 
-func (c *handlerClient) PostServiceMetricValues(name string, metrics []*mackerel.MetricValue) error {
+func (c *handlerClient) PostServiceMetricValues(ctx context.Context, name string, metrics []*mackerel.MetricValue) error {
 	// BUG(lufia): The pull mode don't support to post the service metrics.
 	return nil
 }
@@ -0,0 +1,240 @@
+package mackerel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// HostSyncFilter restricts hosts that the exporter lists to warm up the host cache.
+type HostSyncFilter struct {
+	// Service and Roles are passed to Mackerel's host list API.
+	Service string
+	Roles   []string
+
+	// Prefix restricts hosts to whose customIdentifier starts with Prefix.
+	// If it is set, the exporter assumes that hosts with the prefix not in the list don't exist,
+	// so it creates them without looking up one by one.
+	Prefix string
+}
+
+// allHostStatuses are passed to FindHosts because Mackerel lists only working and standby hosts by default.
+var allHostStatuses = []string{
+	mackerel.HostStatusWorking,
+	mackerel.HostStatusStandby,
+	mackerel.HostStatusMaintenance,
+	mackerel.HostStatusPoweroff,
+}
+
+// hostCache maps customIdentifiers to Mackerel's host IDs.
+// The exporter looks up the cache before it calls FindHosts for each host.
+type hostCache struct {
+	file   string // if it is not empty, the cache is persisted to the file
+	ids    map[string]string
+	synced time.Time // the last time that the cache is refreshed with the host list
+	dirty  bool      // ids is changed since the last save
+}
+
+func newHostCache(file string) (*hostCache, error) {
+	c := &hostCache{
+		file: file,
+		ids:  make(map[string]string),
+	}
+	if file == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.ids); err != nil {
+		global.Handle(fmt.Errorf("ignore the host cache %s: %w", file, err))
+		c.ids = make(map[string]string)
+	}
+	return c, nil
+}
+
+// marshal returns the content of the file if the cache is changed since the last call.
+// It returns nil if the cache don't have to be saved.
+func (c *hostCache) marshal() ([]byte, error) {
+	if c.file == "" || !c.dirty {
+		return nil, nil
+	}
+	data, err := json.Marshal(c.ids)
+	if err != nil {
+		return nil, err
+	}
+	c.dirty = false
+	return data, nil
+}
+
+// writeFile writes data into a temporary file, then renames it to file
+// so that the file is not broken even if the process exits while writing.
+func writeFile(file string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (c *hostCache) set(customIdentifier, hostID string) {
+	if c.ids[customIdentifier] == hostID {
+		return
+	}
+	c.ids[customIdentifier] = hostID
+	c.dirty = true
+}
+
+func (c *hostCache) remove(customIdentifier string) {
+	if _, ok := c.ids[customIdentifier]; !ok {
+		return
+	}
+	delete(c.ids, customIdentifier)
+	c.dirty = true
+}
+
+// sync merges ids that are listed with the filter into the cache.
+// The cache also holds hosts out of the filter, such as ones loaded from the file,
+// so only the hosts with prefix that are not listed are removed.
+func (c *hostCache) sync(ids map[string]string, prefix string, now time.Time) {
+	for id, hostID := range ids {
+		c.set(id, hostID)
+	}
+	if prefix != "" {
+		for id := range c.ids {
+			if _, ok := ids[id]; !ok && strings.HasPrefix(id, prefix) {
+				c.remove(id)
+			}
+		}
+	}
+	c.synced = now
+}
+
+// saveHostCache saves the host cache, and reports the error to the global error handler
+// because the cache is only an optimization.
+// The file is written without holding e.entityMu, so that the registrations don't wait for it.
+func (e *Exporter) saveHostCache() {
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+	e.entityMu.Lock()
+	data, err := e.hostCache.marshal()
+	e.entityMu.Unlock()
+	if err == nil && data != nil {
+		if err = writeFile(e.hostCache.file, data); err != nil {
+			e.entityMu.Lock()
+			e.hostCache.dirty = true
+			e.entityMu.Unlock()
+		}
+	}
+	if err != nil {
+		global.Handle(fmt.Errorf("can't save the host cache: %w", err))
+	}
+}
+
+// syncHosts refreshes the host cache with the host list if it is enabled and outdated.
+func (e *Exporter) syncHosts(ctx context.Context, now time.Time) error {
+	if e.opts.HostSync == nil {
+		return nil
+	}
+	unlock, err := e.lockEntity(ctx, entityKey("hosts", ""))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	e.entityMu.Lock()
+	c := e.hostCache
+	synced := c.synced
+	e.entityMu.Unlock()
+	if !synced.IsZero() && (e.opts.HostSyncInterval <= 0 || now.Sub(synced) < e.opts.HostSyncInterval) {
+		return nil
+	}
+	f := e.opts.HostSync
+	a, err := e.c.FindHosts(ctx, &mackerel.FindHostsParam{
+		Service:  f.Service,
+		Roles:    f.Roles,
+		Statuses: allHostStatuses,
+	})
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]string)
+	for _, h := range a {
+		if h.CustomIdentifier == "" || !strings.HasPrefix(h.CustomIdentifier, f.Prefix) {
+			continue
+		}
+		ids[h.CustomIdentifier] = h.ID
+	}
+	e.entityMu.Lock()
+	c.sync(ids, f.Prefix, now)
+	e.entityMu.Unlock()
+	return nil
+}
+
+// lookupHostID returns the host ID of customIdentifier.
+// It also reports whether the ID came from the cache.
+// The caller must hold the entity key of the host.
+func (e *Exporter) lookupHostID(ctx context.Context, customIdentifier string) (string, bool, error) {
+	if customIdentifier == "" {
+		return "", false, errors.New("customIdentifier must be specified")
+	}
+	e.entityMu.Lock()
+	id, ok := e.hostCache.ids[customIdentifier]
+	synced := e.hostCache.synced
+	e.entityMu.Unlock()
+	if ok {
+		return id, true, nil
+	}
+	if f := e.opts.HostSync; f != nil && f.Prefix != "" && !synced.IsZero() {
+		if strings.HasPrefix(customIdentifier, f.Prefix) {
+			return "", true, nil
+		}
+	}
+	a, err := e.c.FindHosts(ctx, &mackerel.FindHostsParam{
+		CustomIdentifier: customIdentifier,
+		Statuses:         allHostStatuses,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if len(a) == 0 {
+		return "", false, nil
+	}
+	e.entityMu.Lock()
+	e.hostCache.set(customIdentifier, a[0].ID)
+	e.entityMu.Unlock()
+	return a[0].ID, false, nil
+}
+
+// isNotFound reports whether err means that the host is not found.
+func isNotFound(err error) bool {
+	var p *APIError
+	return errors.As(err, &p) && p.StatusCode == http.StatusNotFound
+}
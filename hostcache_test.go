@@ -0,0 +1,199 @@
+package mackerel
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// lookupClient counts FindHosts calls.
+// Like Mackerel, it lists only working and standby hosts unless statuses are specified.
+// Also it returns *APIError with 404 when the host to update is not exist.
+type lookupClient struct {
+	handlerClient
+	mu    sync.Mutex
+	finds int
+}
+
+func (c *lookupClient) FindHosts(ctx context.Context, param *mackerel.FindHostsParam) ([]*mackerel.Host, error) {
+	c.mu.Lock()
+	c.finds++
+	c.mu.Unlock()
+	a, err := c.handlerClient.FindHosts(ctx, param)
+	if err != nil {
+		return nil, err
+	}
+	statuses := param.Statuses
+	if len(statuses) == 0 {
+		statuses = []string{mackerel.HostStatusWorking, mackerel.HostStatusStandby}
+	}
+	var hosts []*mackerel.Host
+	for _, h := range a {
+		status := h.Status
+		if status == "" {
+			status = mackerel.HostStatusWorking
+		}
+		for _, s := range statuses {
+			if s == status {
+				hosts = append(hosts, h)
+				break
+			}
+		}
+	}
+	return hosts, nil
+}
+
+func (c *lookupClient) UpdateHost(ctx context.Context, hostID string, param *mackerel.UpdateHostParam) (string, error) {
+	id, err := c.handlerClient.UpdateHost(ctx, hostID, param)
+	if err != nil {
+		return "", &APIError{StatusCode: 404, HostID: hostID, Err: err}
+	}
+	return id, nil
+}
+
+func hostRecords(ids ...string) []testRecord {
+	var a []testRecord
+	for _, id := range ids {
+		a = append(a, testRecord{"requests", 1, []label.KeyValue{KeyHostID.String(id)}})
+	}
+	return a
+}
+
+func TestExporterHostSync(t *testing.T) {
+	ctx := context.Background()
+	c := &lookupClient{}
+	for _, id := range []string{"pod-1", "pod-2", "other"} {
+		if _, err := c.CreateHost(ctx, &mackerel.CreateHostParam{Name: id, CustomIdentifier: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The host in maintenance is also listed.
+	if err := c.UpdateHostStatus(ctx, "2", mackerel.HostStatusMaintenance); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExporter(t, c, WithHostSync(HostSyncFilter{Prefix: "pod-"}, time.Hour))
+	cs := newCheckpointSet(t, hostRecords("pod-1", "pod-2", "pod-3")...)
+	if err := e.Export(ctx, cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if c.finds != 1 {
+		t.Errorf("FindHosts is called %d times; want 1", c.finds)
+	}
+	if n := len(c.hosts); n != 4 {
+		t.Errorf("len(hosts) = %d; want 4", n)
+	}
+	if _, ok := e.hostCache.ids["other"]; ok {
+		t.Error("the host that don't match the prefix is cached")
+	}
+}
+
+func TestExporterHostCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts.json")
+
+	ctx := context.Background()
+	c := &lookupClient{}
+	e := newTestExporter(t, c, WithHostCacheFile(file))
+	if err := e.Export(ctx, newCheckpointSet(t, hostRecords("1-2-3-4")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+
+	c.finds = 0
+	e = newTestExporter(t, c, WithHostCacheFile(file))
+	if err := e.Export(ctx, newCheckpointSet(t, hostRecords("1-2-3-4")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if c.finds != 0 {
+		t.Errorf("FindHosts is called %d times; want 0", c.finds)
+	}
+	if n := len(c.hosts); n != 1 {
+		t.Errorf("len(hosts) = %d; want 1", n)
+	}
+
+	// The cached host is gone.
+	if err := ioutil.WriteFile(file, []byte(`{"5-6-7-8":"999"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e = newTestExporter(t, c, WithHostCacheFile(file))
+	if err := e.Export(ctx, newCheckpointSet(t, hostRecords("5-6-7-8")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if id := e.hostCache.ids["5-6-7-8"]; id == "999" || c.hosts[id] == nil {
+		t.Errorf("cached host ID = %q; want a new host", id)
+	}
+}
+
+func TestExporterHostSyncWithCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts.json")
+	if err := ioutil.WriteFile(file, []byte(`{"other":"100","pod-9":"101"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c := &lookupClient{}
+	if _, err := c.CreateHost(ctx, &mackerel.CreateHostParam{Name: "pod-1", CustomIdentifier: "pod-1"}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExporter(t, c, WithHostCacheFile(file), WithHostSync(HostSyncFilter{Prefix: "pod-"}, time.Hour))
+	if err := e.Export(ctx, newCheckpointSet(t, hostRecords("pod-1")...)); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids map[string]string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"other": "100", "pod-1": "1"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("the host cache = %v; want %v", ids, want)
+	}
+}
+
+func TestExporterSaveHostCacheRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cache", "hosts.json")
+
+	e := newTestExporter(t, &lookupClient{}, WithHostCacheFile(file))
+	e.hostCache.set("1-2-3-4", "1")
+	e.saveHostCache() // the directory is not exist
+	if !e.hostCache.dirty {
+		t.Error("the host cache is not dirty after the failure")
+	}
+	if err := os.Mkdir(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	e.saveHostCache()
+	files, err := ioutil.ReadDir(filepath.Dir(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "hosts.json" {
+		t.Errorf("files = %v; want only hosts.json", files)
+	}
+}
@@ -0,0 +1,245 @@
+package mackerel
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/tag"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// sectorSize is the unit of the size of block devices that mackerel-agent reports.
+const sectorSize = 512
+
+// kernelNames maps os.type to the kernel name that mackerel-agent reports.
+var kernelNames = map[string]string{
+	"linux":   "Linux",
+	"darwin":  "Darwin",
+	"windows": "Windows",
+	"freebsd": "FreeBSD",
+	"netbsd":  "NetBSD",
+	"openbsd": "OpenBSD",
+	"solaris": "SunOS",
+}
+
+// hostMeta returns the host specs constructed with r.
+// The formats are compatible with mackerel-agent.
+func hostMeta(r *tag.Resource) mackerel.HostMeta {
+	var meta mackerel.HostMeta
+	if k := kernel(r); len(k) > 0 {
+		meta.Kernel = k
+	}
+	if c := r.Host.CPU; c.ModelName != "" || c.Count > 0 {
+		n := c.Count
+		if n <= 0 {
+			n = 1
+		}
+		for i := int64(0); i < n; i++ {
+			m := make(map[string]interface{})
+			setString(m, "model_name", c.ModelName)
+			setString(m, "vendor_id", c.VendorID)
+			setString(m, "mhz", c.MHz)
+			meta.CPU = append(meta.CPU, m)
+		}
+	}
+	if n := r.Host.Memory.Total; n > 0 {
+		meta.Memory = mackerel.Memory{
+			"total": fmt.Sprintf("%dkB", n/1024),
+		}
+	}
+	for name, v := range r.Host.Disk {
+		attrs, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		d := make(map[string]interface{})
+		if n, ok := parseInt(attrs["size"]); ok {
+			d["size"] = strconv.FormatInt(n/sectorSize, 10)
+		}
+		if s, ok := attrs["removable"].(string); ok {
+			d["removable"] = boolFlag(s)
+		}
+		if meta.BlockDevice == nil {
+			meta.BlockDevice = make(mackerel.BlockDevice)
+		}
+		meta.BlockDevice[name] = d
+	}
+	for name, v := range r.Host.Filesystem {
+		attrs, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fs := make(map[string]interface{})
+		size, hasSize := parseInt(attrs["size"])
+		used, hasUsed := parseInt(attrs["used"])
+		if hasSize {
+			fs["kb_size"] = size / 1024
+		}
+		if hasUsed {
+			fs["kb_used"] = used / 1024
+		}
+		if hasSize && hasUsed {
+			fs["kb_available"] = (size - used) / 1024
+			if size > 0 {
+				fs["percent_used"] = fmt.Sprintf("%d%%", used*100/size)
+			}
+		}
+		if s, ok := attrs["mount"].(string); ok {
+			fs["mount"] = s
+		}
+		if meta.Filesystem == nil {
+			meta.Filesystem = make(mackerel.FileSystem)
+		}
+		meta.Filesystem[name] = fs
+	}
+	meta.Cloud = cloudMeta(r)
+	return meta
+}
+
+// These are provider names of Mackerel's cloud integration.
+const (
+	cloudProviderEC2   = "ec2"
+	cloudProviderGCE   = "gce"
+	cloudProviderAzure = "AzureVM"
+)
+
+// cloudMeta returns the cloud metadata that is formed as same as mackerel-agent.
+// If the provider is unknown, cloudMeta returns the metadata that has only the provider.
+func cloudMeta(r *tag.Resource) *mackerel.Cloud {
+	c := &r.Cloud
+	if c.Provider == "" {
+		return nil
+	}
+	zone := c.AvailabilityZoneName()
+	m := make(map[string]string)
+	var provider string
+	switch c.Provider {
+	case "aws":
+		provider = cloudProviderEC2
+		setValue(m, "instance-id", r.Host.ID)
+		setValue(m, "instance-type", r.Host.Type)
+		setValue(m, "ami-id", r.Host.Image.ID)
+		setValue(m, "hostname", r.Host.Name)
+		setValue(m, "placement/availability-zone", zone)
+		setValue(m, "placement/region", c.Region)
+		setValue(m, "account-id", c.Account.ID)
+	case "gcp":
+		provider = cloudProviderGCE
+		setValue(m, "instanceId", r.Host.ID)
+		setValue(m, "machineType", r.Host.Type)
+		setValue(m, "image", r.Host.Image.Name)
+		setValue(m, "hostname", r.Host.Name)
+		setValue(m, "zone", zone)
+		setValue(m, "region", c.Region)
+		setValue(m, "projectId", c.Account.ID)
+	case "azure":
+		provider = cloudProviderAzure
+		setValue(m, "vmId", r.Host.ID)
+		setValue(m, "vmSize", r.Host.Type)
+		setValue(m, "name", r.Host.Name)
+		setValue(m, "location", c.Region)
+		setValue(m, "zone", zone)
+		setValue(m, "subscriptionId", c.Account.ID)
+	default:
+		return &mackerel.Cloud{Provider: c.Provider}
+	}
+	cloud := &mackerel.Cloud{Provider: provider}
+	if len(m) > 0 {
+		cloud.MetaData = m
+	}
+	return cloud
+}
+
+func kernel(r *tag.Resource) mackerel.Kernel {
+	k := make(mackerel.Kernel)
+	if s := r.OS.Type; s != "" {
+		if name, ok := kernelNames[s]; ok {
+			s = name
+		}
+		k["name"] = s
+	}
+	setValue(k, "release", r.OS.Version)
+	setValue(k, "version", r.OS.Description)
+	setValue(k, "machine", r.Host.Arch)
+	setValue(k, "platform_name", r.OS.Name)
+	return k
+}
+
+// hostInterfaces returns network interfaces of the host, sorted by the name.
+func hostInterfaces(r *tag.Resource) []mackerel.Interface {
+	names := make([]string, 0, len(r.Host.Interface))
+	for name := range r.Host.Interface {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var a []mackerel.Interface
+	for _, name := range names {
+		attrs, ok := r.Host.Interface[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		i := mackerel.Interface{
+			Name:          name,
+			IPv4Addresses: splitList(attrs["ipv4"]),
+			IPv6Addresses: splitList(attrs["ipv6"]),
+		}
+		if s, ok := attrs["mac"].(string); ok {
+			i.MacAddress = s
+		}
+		if len(i.IPv4Addresses) > 0 {
+			i.IPAddress = i.IPv4Addresses[0]
+		}
+		a = append(a, i)
+	}
+	return a
+}
+
+func setString(m map[string]interface{}, key, s string) {
+	if s != "" {
+		m[key] = s
+	}
+}
+
+func setValue(m map[string]string, key, s string) {
+	if s != "" {
+		m[key] = s
+	}
+}
+
+func parseInt(v interface{}) (int64, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// boolFlag converts s to "1" or "0" as same as sysfs.
+func boolFlag(s string) string {
+	if b, err := strconv.ParseBool(s); err == nil && b {
+		return "1"
+	}
+	return "0"
+}
+
+// splitList splits the comma-separated value v.
+func splitList(v interface{}) []string {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return nil
+	}
+	var a []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			a = append(a, p)
+		}
+	}
+	return a
+}
@@ -0,0 +1,140 @@
+package mackerel
+
+import (
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/tag"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func TestHostMeta(t *testing.T) {
+	labels := []label.KeyValue{
+		KeyHostID.String("1-2-3-4"),
+		KeyHostArch.String("x86_64"),
+		KeyOSType.String("linux"),
+		KeyOSVersion.String("5.4.0"),
+		KeyHostCPUModelName.String("Xeon"),
+		KeyHostCPUCount.Int64(2),
+		KeyHostMemoryTotal.Int64(2 << 30),
+		label.Key("host.disk.sda.size").Int64(1 << 30),
+		label.Key("host.filesystem./dev/sda1.size").Int64(4 << 20),
+		label.Key("host.filesystem./dev/sda1.used").Int64(1 << 20),
+		label.Key("host.filesystem./dev/sda1.mount").String("/"),
+		label.Key("host.interface.eth0.ipv4").String("192.0.2.1, 192.0.2.2"),
+		label.Key("host.interface.eth0.mac").String("00:00:5e:00:53:01"),
+	}
+	var r tag.Resource
+	if err := tag.UnmarshalTags(labels, &r); err != nil {
+		t.Fatal(err)
+	}
+	meta := hostMeta(&r)
+	want := mackerel.HostMeta{
+		Kernel: mackerel.Kernel{
+			"name":    "Linux",
+			"release": "5.4.0",
+			"machine": "x86_64",
+		},
+		CPU: mackerel.CPU{
+			{"model_name": "Xeon"},
+			{"model_name": "Xeon"},
+		},
+		Memory: mackerel.Memory{"total": "2097152kB"},
+		BlockDevice: mackerel.BlockDevice{
+			"sda": {"size": "2097152"},
+		},
+		Filesystem: mackerel.FileSystem{
+			"/dev/sda1": map[string]interface{}{
+				"kb_size":      int64(4096),
+				"kb_used":      int64(1024),
+				"kb_available": int64(3072),
+				"percent_used": "25%",
+				"mount":        "/",
+			},
+		},
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("hostMeta() = %+v; want %+v", meta, want)
+	}
+
+	a := hostInterfaces(&r)
+	wantInterfaces := []mackerel.Interface{
+		{
+			Name:          "eth0",
+			IPAddress:     "192.0.2.1",
+			IPv4Addresses: []string{"192.0.2.1", "192.0.2.2"},
+			MacAddress:    "00:00:5e:00:53:01",
+		},
+	}
+	if !reflect.DeepEqual(a, wantInterfaces) {
+		t.Errorf("hostInterfaces() = %+v; want %+v", a, wantInterfaces)
+	}
+}
+
+func TestCloudMeta(t *testing.T) {
+	tests := []struct {
+		r    tag.Resource
+		want *mackerel.Cloud
+	}{
+		{
+			r:    tag.Resource{},
+			want: nil,
+		},
+		{
+			r: tag.Resource{
+				Host: tag.Host{ID: "i-0123", Type: "t3.micro"},
+				Cloud: tag.Cloud{
+					Provider: "aws",
+					Region:   "ap-northeast-1",
+					Zone:     "ap-northeast-1a",
+				},
+			},
+			want: &mackerel.Cloud{
+				Provider: "ec2",
+				MetaData: map[string]string{
+					"instance-id":                 "i-0123",
+					"instance-type":               "t3.micro",
+					"placement/availability-zone": "ap-northeast-1a",
+					"placement/region":            "ap-northeast-1",
+				},
+			},
+		},
+		{
+			r: tag.Resource{
+				Cloud: tag.Cloud{
+					Provider:         "gcp",
+					Account:          tag.Account{ID: "project"},
+					Zone:             "us-central1-a",
+					AvailabilityZone: "us-central1-b",
+				},
+			},
+			want: &mackerel.Cloud{
+				Provider: "gce",
+				MetaData: map[string]string{
+					"projectId": "project",
+					"zone":      "us-central1-b",
+				},
+			},
+		},
+		{
+			r: tag.Resource{
+				Cloud: tag.Cloud{Provider: "azure"},
+			},
+			want: &mackerel.Cloud{Provider: "AzureVM"},
+		},
+		{
+			r: tag.Resource{
+				Cloud: tag.Cloud{Provider: "other", Region: "r1"},
+			},
+			want: &mackerel.Cloud{Provider: "other"},
+		},
+	}
+	for _, tt := range tests {
+		c := cloudMeta(&tt.r)
+		if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("cloudMeta(%+v) = %+v; want %+v", tt.r.Cloud, c, tt.want)
+		}
+	}
+}
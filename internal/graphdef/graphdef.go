@@ -11,18 +11,18 @@ import (
 	"github.com/mackerelio/mackerel-client-go"
 )
 
-const (
-	unitDimensionless = unit.Dimensionless
-	unitBytes         = unit.Bytes
-	unitMilliseconds  = unit.Milliseconds
-)
-
 // Options represents options for customizing Mackerel's Graph Definition.
 type Options struct {
 	Name      string
 	Unit      unit.Unit
 	Kind      metric.NumberKind
 	Quantiles []float64
+
+	// These override the automatic definition if they are set.
+	DisplayName string
+	GraphUnit   string // Mackerel's unit, such as "bytes/sec"
+	Stacked     bool
+	Series      map[string]string // display names for the last element of metric names
 }
 
 var errMismatch = errors.New("mismatched metric names")
@@ -30,7 +30,7 @@ var errMismatch = errors.New("mismatched metric names")
 // New returns Mackerel's Graph Definition. Each names in arguments must be canonicalized.
 func New(name string, kind metric.Kind, opts Options) (*mackerel.GraphDefsParam, error) {
 	if opts.Unit == "" {
-		opts.Unit = unitDimensionless
+		opts.Unit = unit.Dimensionless
 	}
 	if kind == metric.ValueRecorderKind {
 		name = metricname.Join(name, "max") // Anything is fine
@@ -42,14 +42,48 @@ func New(name string, kind metric.Kind, opts Options) (*mackerel.GraphDefsParam,
 	if !metricname.Match(name, r) {
 		return nil, errMismatch
 	}
-	return &mackerel.GraphDefsParam{
+	g := &mackerel.GraphDefsParam{
 		Name:        opts.Name,
 		DisplayName: opts.Name,
 		Unit:        graphUnit(opts.Unit, opts.Kind),
-		Metrics: []*mackerel.GraphDefsMetric{
-			{Name: r, DisplayName: metricDisplayName(r)},
-		},
-	}, nil
+	}
+	if opts.DisplayName != "" {
+		g.DisplayName = opts.DisplayName
+	}
+	if opts.GraphUnit != "" {
+		g.Unit = opts.GraphUnit
+	}
+	var elems []string
+	if kind == metric.ValueRecorderKind {
+		elems = append(elems, "min", "max")
+		for _, q := range opts.Quantiles {
+			elems = append(elems, metricname.Percentile(q))
+		}
+	} else {
+		a := metricname.Split(name)
+		elems = append(elems, a[len(a)-1])
+	}
+	wildcard := false
+	for _, elem := range elems {
+		s, ok := opts.Series[elem]
+		if !ok {
+			wildcard = true
+			continue
+		}
+		g.Metrics = append(g.Metrics, &mackerel.GraphDefsMetric{
+			Name:        metricname.Join(opts.Name, elem),
+			DisplayName: s,
+			IsStacked:   opts.Stacked,
+		})
+	}
+	if wildcard {
+		g.Metrics = append(g.Metrics, &mackerel.GraphDefsMetric{
+			Name:        r,
+			DisplayName: metricDisplayName(r),
+			IsStacked:   opts.Stacked,
+		})
+	}
+	return g, nil
 }
 
 func metricDisplayName(name string) string {
@@ -70,18 +104,11 @@ func metricDisplayName(name string) string {
 }
 
 func graphUnit(u unit.Unit, kind metric.NumberKind) string {
-	switch u {
-	case unit.Bytes:
-		return "bytes"
-	case unit.Dimensionless, unit.Milliseconds:
-		if kind == metric.Float64NumberKind {
-			return "float"
-		}
+	if s, _ := ConvertUnit(u); s != "" {
+		return s
+	}
+	if u == unit.Dimensionless && kind != metric.Float64NumberKind {
 		return "integer"
-	default:
-		if kind == metric.Float64NumberKind {
-			return "float"
-		}
-		return "float"
 	}
+	return "float"
 }
@@ -70,6 +70,25 @@ func TestNew(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "measure_in_nanoseconds",
+			kind: metric.ValueRecorderKind,
+			name: "custom.http.latency",
+			opts: Options{
+				Unit: "ns",
+			},
+			want: &mackerel.GraphDefsParam{
+				Name:        "custom.http.latency",
+				DisplayName: "custom.http.latency",
+				Unit:        "milliseconds",
+				Metrics: []*mackerel.GraphDefsMetric{
+					{
+						Name:        "custom.http.latency.*",
+						DisplayName: "%1",
+					},
+				},
+			},
+		},
 		{
 			desc: "multiple_wildcard",
 			kind: metric.ValueRecorderKind,
@@ -89,6 +108,57 @@ func TestNew(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "counter_with_overrides",
+			kind: metric.CounterKind,
+			name: "custom.ether0.txBytes",
+			opts: Options{
+				DisplayName: "Network",
+				GraphUnit:   "bytes/sec",
+				Stacked:     true,
+				Series:      map[string]string{"txBytes": "Transmit"},
+			},
+			want: &mackerel.GraphDefsParam{
+				Name:        "custom.ether0",
+				DisplayName: "Network",
+				Unit:        "bytes/sec",
+				Metrics: []*mackerel.GraphDefsMetric{
+					{
+						Name:        "custom.ether0.txBytes",
+						DisplayName: "Transmit",
+						IsStacked:   true,
+					},
+				},
+			},
+		},
+		{
+			desc: "measure_with_series",
+			kind: metric.ValueRecorderKind,
+			name: "custom.http.latency",
+			opts: Options{
+				Quantiles: []float64{0.99},
+				Series:    map[string]string{"max": "Max", "percentile_99": "99th percentile"},
+			},
+			want: &mackerel.GraphDefsParam{
+				Name:        "custom.http.latency",
+				DisplayName: "custom.http.latency",
+				Unit:        "integer",
+				Metrics: []*mackerel.GraphDefsMetric{
+					{
+						Name:        "custom.http.latency.max",
+						DisplayName: "Max",
+					},
+					{
+						Name:        "custom.http.latency.percentile_99",
+						DisplayName: "99th percentile",
+					},
+					{
+						Name:        "custom.http.latency.*",
+						DisplayName: "%1",
+					},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
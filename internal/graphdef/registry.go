@@ -0,0 +1,167 @@
+package graphdef
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// ConflictError is returned when Graph Definitions for the same graph are inconsistent.
+type ConflictError struct {
+	Name  string // the name of the graph
+	Field string // such as "unit", "displayName" or "metrics[custom.foo.*]"
+	Old   string
+	New   string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("graph %s: %s conflicts: %q and %q", e.Name, e.Field, e.Old, e.New)
+}
+
+// Set is a set of Graph Definitions that are merged by their names.
+// The zero value is an empty set.
+type Set struct {
+	defs map[string]*mackerel.GraphDefsParam
+}
+
+// Add merges d into the set. Metrics that have the same name are deduplicated.
+// If d conflicts with the definition in the set, Add don't change the set and returns *ConflictError.
+// Add don't retain d.
+func (s *Set) Add(d *mackerel.GraphDefsParam) error {
+	if s.defs == nil {
+		s.defs = make(map[string]*mackerel.GraphDefsParam)
+	}
+	p, ok := s.defs[d.Name]
+	if !ok {
+		s.defs[d.Name] = merge(nil, d)
+		return nil
+	}
+	if err := conflict(p, d); err != nil {
+		return err
+	}
+	s.defs[d.Name] = merge(p, d)
+	return nil
+}
+
+// Len returns the number of graphs in the set.
+func (s *Set) Len() int {
+	return len(s.defs)
+}
+
+// conflict returns *ConflictError if attributes of p and d are different.
+func conflict(p, d *mackerel.GraphDefsParam) error {
+	if p.Unit != d.Unit {
+		return &ConflictError{Name: d.Name, Field: "unit", Old: p.Unit, New: d.Unit}
+	}
+	if p.DisplayName != d.DisplayName {
+		return &ConflictError{Name: d.Name, Field: "displayName", Old: p.DisplayName, New: d.DisplayName}
+	}
+	for _, m := range d.Metrics {
+		for _, o := range p.Metrics {
+			if o.Name != m.Name {
+				continue
+			}
+			field := "metrics[" + m.Name + "]"
+			if o.DisplayName != m.DisplayName {
+				return &ConflictError{Name: d.Name, Field: field + ".displayName", Old: o.DisplayName, New: m.DisplayName}
+			}
+			if o.IsStacked != m.IsStacked {
+				return &ConflictError{Name: d.Name, Field: field + ".isStacked", Old: fmt.Sprint(o.IsStacked), New: fmt.Sprint(m.IsStacked)}
+			}
+		}
+	}
+	return nil
+}
+
+// Registry holds Graph Definitions that exist in Mackerel.
+// The zero value is an empty registry.
+type Registry struct {
+	defs map[string]*mackerel.GraphDefsParam
+}
+
+// Lookup returns the definition of the graph name.
+func (r *Registry) Lookup(name string) (*mackerel.GraphDefsParam, bool) {
+	d, ok := r.defs[name]
+	if !ok {
+		return nil, false
+	}
+	return merge(nil, d), true
+}
+
+// Register records that d exists in Mackerel. It replaces the definition that has the same name.
+func (r *Registry) Register(d *mackerel.GraphDefsParam) {
+	if r.defs == nil {
+		r.defs = make(map[string]*mackerel.GraphDefsParam)
+	}
+	r.defs[d.Name] = merge(nil, d)
+}
+
+// Defs returns all definitions in r, sorted by their names.
+func (r *Registry) Defs() []*mackerel.GraphDefsParam {
+	a := sortedDefs(r.defs)
+	for i, d := range a {
+		a[i] = merge(nil, d)
+	}
+	return a
+}
+
+// Changes returns definitions that should be posted to reflect s to Mackerel, sorted by their names.
+// Mackerel replaces whole the definition, so each results also include metrics that are already registered.
+// The definitions in s that don't change the registered ones are omitted.
+func (r *Registry) Changes(s *Set) []*mackerel.GraphDefsParam {
+	m := make(map[string]*mackerel.GraphDefsParam)
+	for name, d := range s.defs {
+		p, ok := r.defs[name]
+		if !ok {
+			m[name] = merge(nil, d)
+			continue
+		}
+		if g := merge(p, d); !reflect.DeepEqual(g, p) {
+			m[name] = g
+		}
+	}
+	return sortedDefs(m)
+}
+
+func sortedDefs(m map[string]*mackerel.GraphDefsParam) []*mackerel.GraphDefsParam {
+	a := make([]*mackerel.GraphDefsParam, 0, len(m))
+	for _, d := range m {
+		a = append(a, d)
+	}
+	sort.Slice(a, func(i, j int) bool {
+		return a[i].Name < a[j].Name
+	})
+	return a
+}
+
+// merge returns a new definition that has metrics of both p and d.
+// The attributes of the graph and the metrics that have the same name are taken from d.
+// p can be nil.
+func merge(p, d *mackerel.GraphDefsParam) *mackerel.GraphDefsParam {
+	g := &mackerel.GraphDefsParam{
+		Name:        d.Name,
+		DisplayName: d.DisplayName,
+		Unit:        d.Unit,
+	}
+	index := make(map[string]int)
+	add := func(m *mackerel.GraphDefsMetric) {
+		v := *m
+		if i, ok := index[m.Name]; ok {
+			g.Metrics[i] = &v
+			return
+		}
+		index[m.Name] = len(g.Metrics)
+		g.Metrics = append(g.Metrics, &v)
+	}
+	if p != nil {
+		for _, m := range p.Metrics {
+			add(m)
+		}
+	}
+	for _, m := range d.Metrics {
+		add(m)
+	}
+	return g
+}
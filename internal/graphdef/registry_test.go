@@ -0,0 +1,212 @@
+package graphdef
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func graphDef(name, unit string, metrics ...*mackerel.GraphDefsMetric) *mackerel.GraphDefsParam {
+	return &mackerel.GraphDefsParam{
+		Name:        name,
+		DisplayName: name,
+		Unit:        unit,
+		Metrics:     metrics,
+	}
+}
+
+func graphMetric(name, displayName string) *mackerel.GraphDefsMetric {
+	return &mackerel.GraphDefsMetric{Name: name, DisplayName: displayName}
+}
+
+func TestSetAdd(t *testing.T) {
+	var s Set
+	defs := []*mackerel.GraphDefsParam{
+		graphDef("custom.http", "integer", graphMetric("custom.http.requests", "Requests")),
+		graphDef("custom.http", "integer", graphMetric("custom.http.*", "%1")),
+		graphDef("custom.http", "integer", graphMetric("custom.http.requests", "Requests")),
+		graphDef("custom.disk", "bytes", graphMetric("custom.disk.*", "%1")),
+	}
+	for _, d := range defs {
+		if err := s.Add(d); err != nil {
+			t.Fatalf("Add(%s) = %v", d.Name, err)
+		}
+	}
+	defs[0].Metrics[0].DisplayName = "modified"
+
+	var r Registry
+	want := []*mackerel.GraphDefsParam{
+		graphDef("custom.disk", "bytes", graphMetric("custom.disk.*", "%1")),
+		graphDef("custom.http", "integer",
+			graphMetric("custom.http.requests", "Requests"),
+			graphMetric("custom.http.*", "%1"),
+		),
+	}
+	if n := s.Len(); n != len(want) {
+		t.Errorf("Len() = %d; want %d", n, len(want))
+	}
+	if a := r.Changes(&s); !reflect.DeepEqual(a, want) {
+		t.Errorf("Changes() = %v; want %v", a, want)
+	}
+}
+
+func TestSetAddConflict(t *testing.T) {
+	base := graphDef("custom.http", "integer", graphMetric("custom.http.*", "%1"))
+	tests := []struct {
+		desc  string
+		def   *mackerel.GraphDefsParam
+		field string
+	}{
+		{
+			desc:  "unit",
+			def:   graphDef("custom.http", "milliseconds", graphMetric("custom.http.*", "%1")),
+			field: "unit",
+		},
+		{
+			desc: "display_name",
+			def: &mackerel.GraphDefsParam{
+				Name:        "custom.http",
+				DisplayName: "HTTP",
+				Unit:        "integer",
+			},
+			field: "displayName",
+		},
+		{
+			desc:  "metric_display_name",
+			def:   graphDef("custom.http", "integer", graphMetric("custom.http.*", "%2")),
+			field: "metrics[custom.http.*].displayName",
+		},
+		{
+			desc: "metric_stacked",
+			def: graphDef("custom.http", "integer", &mackerel.GraphDefsMetric{
+				Name:        "custom.http.*",
+				DisplayName: "%1",
+				IsStacked:   true,
+			}),
+			field: "metrics[custom.http.*].isStacked",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var s Set
+			if err := s.Add(base); err != nil {
+				t.Fatal(err)
+			}
+			err := s.Add(tt.def)
+			var e *ConflictError
+			if !errors.As(err, &e) {
+				t.Fatalf("Add() = %v; want *ConflictError", err)
+			}
+			if e.Name != "custom.http" || e.Field != tt.field {
+				t.Errorf("ConflictError = {%s %s}; want {custom.http %s}", e.Name, e.Field, tt.field)
+			}
+			var r Registry
+			if a := r.Changes(&s); !reflect.DeepEqual(a, []*mackerel.GraphDefsParam{base}) {
+				t.Errorf("Changes() = %v; want %v", a, base)
+			}
+		})
+	}
+}
+
+func TestRegistryChanges(t *testing.T) {
+	var r Registry
+	r.Register(graphDef("custom.http", "integer", graphMetric("custom.http.requests", "Requests")))
+	r.Register(graphDef("custom.disk", "bytes", graphMetric("custom.disk.*", "%1")))
+
+	tests := []struct {
+		desc string
+		defs []*mackerel.GraphDefsParam
+		want []*mackerel.GraphDefsParam
+	}{
+		{
+			desc: "unchanged",
+			defs: []*mackerel.GraphDefsParam{
+				graphDef("custom.http", "integer", graphMetric("custom.http.requests", "Requests")),
+				graphDef("custom.disk", "bytes", graphMetric("custom.disk.*", "%1")),
+			},
+			want: []*mackerel.GraphDefsParam{},
+		},
+		{
+			desc: "new_metric",
+			defs: []*mackerel.GraphDefsParam{
+				graphDef("custom.http", "integer", graphMetric("custom.http.*", "%1")),
+				graphDef("custom.disk", "bytes", graphMetric("custom.disk.*", "%1")),
+			},
+			want: []*mackerel.GraphDefsParam{
+				graphDef("custom.http", "integer",
+					graphMetric("custom.http.requests", "Requests"),
+					graphMetric("custom.http.*", "%1"),
+				),
+			},
+		},
+		{
+			desc: "changed_unit",
+			defs: []*mackerel.GraphDefsParam{
+				graphDef("custom.disk", "float", graphMetric("custom.disk.*", "%1")),
+			},
+			want: []*mackerel.GraphDefsParam{
+				graphDef("custom.disk", "float", graphMetric("custom.disk.*", "%1")),
+			},
+		},
+		{
+			desc: "changed_metric",
+			defs: []*mackerel.GraphDefsParam{
+				graphDef("custom.http", "integer", graphMetric("custom.http.requests", "Count")),
+			},
+			want: []*mackerel.GraphDefsParam{
+				graphDef("custom.http", "integer", graphMetric("custom.http.requests", "Count")),
+			},
+		},
+		{
+			desc: "new_graphs",
+			defs: []*mackerel.GraphDefsParam{
+				graphDef("custom.queue", "integer", graphMetric("custom.queue.*", "%1")),
+				graphDef("custom.cache", "integer", graphMetric("custom.cache.*", "%1")),
+			},
+			want: []*mackerel.GraphDefsParam{
+				graphDef("custom.cache", "integer", graphMetric("custom.cache.*", "%1")),
+				graphDef("custom.queue", "integer", graphMetric("custom.queue.*", "%1")),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var s Set
+			for _, d := range tt.defs {
+				if err := s.Add(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if a := r.Changes(&s); !reflect.DeepEqual(a, tt.want) {
+				t.Errorf("Changes() = %v; want %v", a, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryIsolation(t *testing.T) {
+	var r Registry
+	d := graphDef("custom.http", "integer", graphMetric("custom.http.*", "%1"))
+	r.Register(d)
+	d.Metrics[0].DisplayName = "modified"
+	d.Metrics = append(d.Metrics, graphMetric("custom.http.requests", "Requests"))
+
+	want := graphDef("custom.http", "integer", graphMetric("custom.http.*", "%1"))
+	p, ok := r.Lookup("custom.http")
+	if !ok {
+		t.Fatal("Lookup(custom.http) is not found")
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Lookup(custom.http) = %v; want %v", p, want)
+	}
+	p.Unit = "float"
+	r.Defs()[0].Metrics[0].Name = "modified"
+	if a := r.Defs(); !reflect.DeepEqual(a, []*mackerel.GraphDefsParam{want}) {
+		t.Errorf("Defs() = %v; want %v", a, want)
+	}
+	if _, ok := r.Lookup("custom.disk"); ok {
+		t.Error("Lookup(custom.disk) is found")
+	}
+}
@@ -0,0 +1,83 @@
+package graphdef
+
+import (
+	"strings"
+
+	"go.opentelemetry.io/otel/unit"
+)
+
+// Mackerel's units of the graph.
+const (
+	UnitPercentage   = "percentage"
+	UnitBytes        = "bytes"
+	UnitBytesPerSec  = "bytes/sec"
+	UnitBitsPerSec   = "bits/sec"
+	UnitSeconds      = "seconds"
+	UnitMilliseconds = "milliseconds"
+)
+
+// see https://ucum.org/ucum.html#section-Prefixes
+var multiples = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+}
+
+// ConvertUnit translates u, a UCUM unit, into Mackerel's unit.
+// It also returns the scale that values in u should be multiplied by to be in Mackerel's unit;
+// for example "ns" is translated into "milliseconds" with the scale 1e-6.
+// If u has no corresponding unit, ConvertUnit returns "" and 1.
+func ConvertUnit(u unit.Unit) (string, float64) {
+	s := string(u)
+	switch s {
+	case "%":
+		return UnitPercentage, 1
+	case "s":
+		return UnitSeconds, 1
+	case "ms":
+		return UnitMilliseconds, 1
+	case "us":
+		return UnitMilliseconds, 1e-3
+	case "ns":
+		return UnitMilliseconds, 1e-6
+	case "min":
+		return UnitSeconds, 60
+	case "h":
+		return UnitSeconds, 60 * 60
+	case "d":
+		return UnitSeconds, 24 * 60 * 60
+	}
+	if t := strings.TrimSuffix(s, "/s"); t != s {
+		if p, ok := prefixed(t, "By"); ok {
+			return UnitBytesPerSec, p
+		}
+		if p, ok := prefixed(t, "bit"); ok {
+			return UnitBitsPerSec, p
+		}
+		return "", 1
+	}
+	if p, ok := prefixed(s, "By"); ok {
+		return UnitBytes, p
+	}
+	if p, ok := prefixed(s, "bit"); ok {
+		return UnitBytes, p / 8
+	}
+	return "", 1
+}
+
+// prefixed returns the scale of the prefix if s is base with a prefix in multiples.
+func prefixed(s, base string) (float64, bool) {
+	if !strings.HasSuffix(s, base) {
+		return 0, false
+	}
+	p, ok := multiples[strings.TrimSuffix(s, base)]
+	return p, ok
+}
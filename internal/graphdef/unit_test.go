@@ -0,0 +1,41 @@
+package graphdef
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/unit"
+)
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		u     unit.Unit
+		want  string
+		scale float64
+	}{
+		{unit.Dimensionless, "", 1},
+		{"{requests}", "", 1},
+		{"%", UnitPercentage, 1},
+		{unit.Bytes, UnitBytes, 1},
+		{"KiBy", UnitBytes, 1024},
+		{"MBy", UnitBytes, 1e6},
+		{"bit", UnitBytes, 0.125},
+		{"By/s", UnitBytesPerSec, 1},
+		{"kBy/s", UnitBytesPerSec, 1e3},
+		{"bit/s", UnitBitsPerSec, 1},
+		{"Gbit/s", UnitBitsPerSec, 1e9},
+		{"{packets}/s", "", 1},
+		{"s", UnitSeconds, 1},
+		{"min", UnitSeconds, 60},
+		{unit.Milliseconds, UnitMilliseconds, 1},
+		{"us", UnitMilliseconds, 1e-3},
+		{"ns", UnitMilliseconds, 1e-6},
+		{"mBy", "", 1},
+		{"ks", "", 1},
+	}
+	for _, tt := range tests {
+		s, scale := ConvertUnit(tt.u)
+		if s != tt.want || scale != tt.scale {
+			t.Errorf("ConvertUnit(%q) = %q, %v; want %q, %v", tt.u, s, scale, tt.want, tt.scale)
+		}
+	}
+}
@@ -71,6 +71,28 @@ func Prefix(s string) string {
 	return strings.Join(a[:len(a)-1], metricNameSep)
 }
 
+// Group returns the name that is grouped into the graph pattern as a service metric.
+// Mackerel groups service metrics into graphs by the name before the final dot,
+// so Group moves the elements of s that match "*" in pattern into the final element
+// to group them into one graph. The elements that match "#" are kept as separate graphs.
+// If the name before the final dot of s is not matched to pattern, Group returns s.
+func Group(s, pattern string) string {
+	a := Split(s)
+	if len(a) < 2 || !Match(Prefix(s), pattern) {
+		return s
+	}
+	var graph, series []string
+	for i, e := range Split(pattern) {
+		if e == "*" {
+			series = append(series, a[i])
+		} else {
+			graph = append(graph, a[i])
+		}
+	}
+	series = append(series, a[len(a)-1])
+	return Join(append(graph, strings.Join(series, "_"))...)
+}
+
 // Percentile returns "percentile_xx".
 func Percentile(q float64) string {
 	return fmt.Sprintf("percentile_%.0f", math.Floor(q*100))
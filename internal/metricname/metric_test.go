@@ -81,6 +81,27 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    string
+	}{
+		{name: "http.index.count", pattern: "http.#", want: "http.index.count"},
+		{name: "http.index.count", pattern: "http.*", want: "http.index_count"},
+		{name: "http.index.latency.max", pattern: "http.*.latency", want: "http.latency.index_max"},
+		{name: "http.index.count", pattern: "db.*", want: "http.index.count"},
+		{name: "http.index.count", pattern: "http", want: "http.index.count"},
+		{name: "requests", pattern: "*", want: "requests"},
+	}
+	for _, tt := range tests {
+		s := Group(tt.name, tt.pattern)
+		if s != tt.want {
+			t.Errorf("Group(%q, %q) = %q; want %q", tt.name, tt.pattern, s, tt.want)
+		}
+	}
+}
+
 func TestIsSystemMetric(t *testing.T) {
 	tests := []struct {
 		name string
@@ -18,6 +18,10 @@ type Resource struct {
 	Service Service `resource:"service"`
 	Host    Host    `resource:"host"`
 	Cloud   Cloud   `resource:"cloud"`
+	OS      OS      `resource:"os,optional"`
+
+	K8S       K8S       `resource:"k8s,optional"`
+	Container Container `resource:"container,optional"`
 }
 
 // Service represents the standard service attributes.
@@ -35,13 +39,100 @@ type Instance struct {
 
 // Host represents the standard host attributes.
 type Host struct {
-	ID   string `resource:"id"`
-	Name string `resource:"name"`
+	ID    string `resource:"id"`
+	Name  string `resource:"name"`
+	Type  string `resource:"type,optional"`
+	Arch  string `resource:"arch,optional"`
+	Image Image  `resource:"image,optional"`
+
+	// These are extensions for Mackerel's hosts.
+	Status     string                 `resource:"status,optional"`
+	CPU        CPU                    `resource:"cpu,optional"`
+	Memory     Memory                 `resource:"memory,optional"`
+	Disk       map[string]interface{} `resource:"disk,optional"`
+	Filesystem map[string]interface{} `resource:"filesystem,optional"`
+	Interface  map[string]interface{} `resource:"interface,optional"`
+}
+
+// Image represents the standard host image attributes.
+type Image struct {
+	Name    string `resource:"name"`
+	ID      string `resource:"id"`
+	Version string `resource:"version"`
+}
+
+// CPU represents CPU attributes of the host.
+type CPU struct {
+	ModelName string `resource:"model_name"`
+	VendorID  string `resource:"vendor_id"`
+	MHz       string `resource:"mhz"`
+	Count     int64  `resource:"count"`
+}
+
+// Memory represents memory attributes of the host.
+type Memory struct {
+	Total int64 `resource:"total"` // bytes
+}
+
+// OS represents the standard operating system attributes.
+type OS struct {
+	Type        string `resource:"type"`
+	Description string `resource:"description"`
+	Name        string `resource:"name"`
+	Version     string `resource:"version"`
 }
 
 // Cloud represents the standard cloud attributes.
 type Cloud struct {
-	Provider string `resource:"provider"`
+	Provider         string  `resource:"provider"`
+	Account          Account `resource:"account,optional"`
+	Region           string  `resource:"region,optional"`
+	Zone             string  `resource:"zone,optional"`
+	AvailabilityZone string  `resource:"availability_zone,optional"`
+}
+
+// Account represents the standard cloud account attributes.
+type Account struct {
+	ID string `resource:"id"`
+}
+
+// AvailabilityZoneName returns the zone where the resource is running.
+// Newer spec names cloud.zone as cloud.availability_zone, so it accepts both.
+func (c *Cloud) AvailabilityZoneName() string {
+	if c.AvailabilityZone != "" {
+		return c.AvailabilityZone
+	}
+	return c.Zone
+}
+
+// K8S represents the standard Kubernetes attributes.
+type K8S struct {
+	Cluster     Object `resource:"cluster"`
+	Namespace   Object `resource:"namespace"`
+	Pod         Object `resource:"pod"`
+	Container   Object `resource:"container,optional"`
+	Deployment  Object `resource:"deployment"`
+	StatefulSet Object `resource:"statefulset"`
+	DaemonSet   Object `resource:"daemonset"`
+}
+
+// Object represents attributes of a Kubernetes object.
+type Object struct {
+	UID  string `resource:"uid"`
+	Name string `resource:"name"`
+}
+
+// Container represents the standard container attributes.
+type Container struct {
+	Name  string         `resource:"name"`
+	ID    string         `resource:"id"`
+	Image ContainerImage `resource:"image"`
+}
+
+// ContainerImage represents the standard container image attributes.
+type ContainerImage struct {
+	Name string `resource:"name"`
+	Tag  string `resource:"tag"`
 }
 
 // Hostname returns a proper hostname.
@@ -131,7 +222,10 @@ func unmarshalTags(name string, keys []string, value label.Value, v reflect.Valu
 		if !ok {
 			return nil // ignore this field
 		}
-		return unmarshalTags(keys[0], keys[1:], value, f)
+		if err := unmarshalTags(keys[0], keys[1:], value, f.v); err != nil && !f.optional {
+			return err
+		}
+		return nil
 	case reflect.Interface:
 		if v.IsNil() {
 			v.Set(reflect.ValueOf(map[string]interface{}{}))
@@ -141,6 +235,12 @@ func unmarshalTags(name string, keys []string, value label.Value, v reflect.Valu
 		if len(keys) == 0 {
 			return fmt.Errorf("%s is %v", name, kind)
 		}
+		if v.IsNil() {
+			if !v.CanSet() {
+				return nil
+			}
+			v.Set(reflect.MakeMap(v.Type()))
+		}
 		key := reflect.ValueOf(keys[0])
 		if len(keys) == 1 {
 			v.SetMapIndex(key, reflect.ValueOf(value.Emit()))
@@ -201,18 +301,34 @@ func unmarshalTags(name string, keys []string, value label.Value, v reflect.Valu
 	}
 }
 
-// collectFields returns a map pointed to fields by the `meta` tag.
-func collectFields(v reflect.Value) map[string]reflect.Value {
-	a := make(map[string]reflect.Value)
+type field struct {
+	v reflect.Value
+
+	// optional fields ignore labels that don't match their shape,
+	// such as "host.cpu" for the struct, so that ordinary labels don't break the resource.
+	optional bool
+}
+
+// collectFields returns a map pointed to fields by the `resource` tag.
+// The tag is formed as "name[,optional]".
+func collectFields(v reflect.Value) map[string]field {
+	a := make(map[string]field)
 	t := v.Type()
 	n := v.NumField()
 	for i := 0; i < n; i++ {
 		f := t.Field(i)
-		name := f.Tag.Get("resource")
+		opts := strings.Split(f.Tag.Get("resource"), ",")
+		name := opts[0]
 		if name == "" {
 			name = f.Name
 		}
-		a[name] = v.Field(i)
+		var optional bool
+		for _, s := range opts[1:] {
+			if s == "optional" {
+				optional = true
+			}
+		}
+		a[name] = field{v: v.Field(i), optional: optional}
 	}
 	return a
 }
@@ -111,3 +111,58 @@ func TestCustomIdentifier(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalTagsMap(t *testing.T) {
+	labels := []label.KeyValue{
+		label.Key("host.disk.sda.size").Int64(1024),
+		label.Key("host.filesystem./dev/sda1.mount").String("/"),
+		label.Key("host.cpu.count").Int64(4),
+	}
+	var m Resource
+	if err := UnmarshalTags(labels, &m); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := lookupInterfaceMap(m.Host.Disk, "sda", "size").(string); !ok || s != "1024" {
+		t.Errorf("host.disk.sda.size = %v; want 1024", s)
+	}
+	if s, ok := lookupInterfaceMap(m.Host.Filesystem, "/dev/sda1", "mount").(string); !ok || s != "/" {
+		t.Errorf("host.filesystem./dev/sda1.mount = %v; want /", s)
+	}
+	if m.Host.CPU.Count != 4 {
+		t.Errorf("host.cpu.count = %d; want 4", m.Host.CPU.Count)
+	}
+}
+
+func TestUnmarshalTagsShapeMismatch(t *testing.T) {
+	labels := []label.KeyValue{
+		label.Key("host.id").String("i-0001"),
+		label.Key("host.cpu").String("cpu0"),
+		label.Key("host.memory.total.free").Int64(1024),
+		label.Key("host.disk").String("sda"),
+		label.Key("host.interface.eth0").String("up"),
+		label.Key("host.interface.eth0.ipAddress").String("192.168.0.1"),
+		label.Key("k8s.pod").String("web"),
+		label.Key("container.image").String("nginx"),
+		label.Key("cloud.account").String("1234"),
+	}
+	var m Resource
+	if err := UnmarshalTags(labels, &m); err != nil {
+		t.Fatal(err)
+	}
+	want := Resource{
+		Host: Host{
+			ID:        "i-0001",
+			Interface: map[string]interface{}{"eth0": "up"},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Resource = %v; want %v", m, want)
+	}
+
+	core := []label.KeyValue{
+		label.Key("host.id.value").String("i-0001"),
+	}
+	if err := UnmarshalTags(core, &m); err == nil {
+		t.Error("UnmarshalTags(host.id.value) = nil; want an error")
+	}
+}
@@ -1,6 +1,7 @@
 package mackerel
 
 import (
+	"go.opentelemetry.io/otel/label"
 	"go.opentelemetry.io/otel/semconv"
 )
 
@@ -13,5 +14,41 @@ var (
 	KeyServiceVersion    = semconv.ServiceVersionKey
 	KeyHostID            = semconv.HostIDKey
 	KeyHostName          = semconv.HostNameKey
+	KeyHostType          = semconv.HostTypeKey
+	KeyHostImageName     = semconv.HostImageNameKey
+	KeyHostImageID       = semconv.HostImageIDKey
+	KeyHostImageVersion  = semconv.HostImageVersionKey
 	KeyCloudProvider     = semconv.CloudProviderKey
+	KeyCloudAccountID    = semconv.CloudAccountIDKey
+	KeyCloudRegion       = semconv.CloudRegionKey
+	KeyCloudZone         = semconv.CloudZoneKey
+	KeyK8SClusterName    = semconv.K8SClusterNameKey
+	KeyK8SNamespaceName  = semconv.K8SNamespaceNameKey
+	KeyK8SPodUID         = semconv.K8SPodUIDKey
+	KeyK8SPodName        = semconv.K8SPodNameKey
+	KeyK8SDeploymentName = semconv.K8SDeploymentNameKey
+	KeyContainerName     = semconv.ContainerNameKey
+	KeyContainerID       = semconv.ContainerIDKey
+
+	// These keys are not defined in semconv package yet.
+	KeyHostArch              = label.Key("host.arch")
+	KeyOSType                = label.Key("os.type")
+	KeyOSDescription         = label.Key("os.description")
+	KeyOSName                = label.Key("os.name")
+	KeyOSVersion             = label.Key("os.version")
+	KeyCloudAvailabilityZone = label.Key("cloud.availability_zone")
+)
+
+// These keys are the exporter's extensions for hosts in Mackerel.
+// Block devices, filesystems and network interfaces are specified with
+// host.disk.<name>.*, host.filesystem.<device>.* and host.interface.<name>.* keys.
+var (
+	KeyHostCPUModelName = label.Key("host.cpu.model_name")
+	KeyHostCPUVendorID  = label.Key("host.cpu.vendor_id")
+	KeyHostCPUMHz       = label.Key("host.cpu.mhz")
+	KeyHostCPUCount     = label.Key("host.cpu.count")
+	KeyHostMemoryTotal  = label.Key("host.memory.total")
+
+	// KeyHostStatus sets the status of the host; working, standby, maintenance or poweroff.
+	KeyHostStatus = label.Key("host.status")
 )
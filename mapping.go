@@ -0,0 +1,135 @@
+package mackerel
+
+import (
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/tag"
+)
+
+// ResourceMapping represents how the exporter maps Kubernetes or container attributes
+// to Mackerel's hosts, services and roles. Mappings can be combined with bitwise OR.
+type ResourceMapping int
+
+const (
+	// MapPodAsHost maps a pod to a host.
+	// The customIdentifier of the host is k8s.pod.uid, and its name is k8s.pod.name.
+	MapPodAsHost ResourceMapping = 1 << iota
+
+	// MapContainerAsHost maps a container to a host.
+	// The customIdentifier of the host is container.id, and its name is container.name.
+	// MapPodAsHost takes precedence if both are set and the pod is known.
+	MapContainerAsHost
+
+	// MapDeploymentAsRole maps k8s.cluster.name to the service,
+	// and k8s.deployment.name to the role. If the deployment is not known,
+	// the name of the StatefulSet or the DaemonSet is used as the role.
+	MapDeploymentAsRole
+)
+
+// apply overwrites host and service attributes of r with Kubernetes or container attributes.
+func (m ResourceMapping) apply(r *tag.Resource) {
+	switch {
+	case m&MapPodAsHost != 0 && r.K8S.Pod.UID != "":
+		replaceHost(r, r.K8S.Pod.UID, r.K8S.Pod.Name)
+	case m&MapContainerAsHost != 0 && r.Container.ID != "":
+		replaceHost(r, r.Container.ID, r.Container.Name)
+	}
+	if m&MapDeploymentAsRole != 0 && r.K8S.Cluster.Name != "" {
+		if role := workloadName(&r.K8S); role != "" {
+			r.Service.NS = r.K8S.Cluster.Name
+			r.Service.Name = role
+		}
+	}
+}
+
+// replaceHost replaces the host of r with id and name.
+// The specs of the host, such as CPU or disks, are dropped because they belong to the node.
+func replaceHost(r *tag.Resource, id, name string) {
+	r.Host = tag.Host{
+		ID:     id,
+		Name:   name,
+		Status: r.Host.Status,
+	}
+}
+
+func workloadName(k *tag.K8S) string {
+	for _, o := range []tag.Object{k.Deployment, k.StatefulSet, k.DaemonSet} {
+		if o.Name != "" {
+			return o.Name
+		}
+	}
+	return ""
+}
+
+// Entity represents Mackerel's host or service that a record belongs to.
+type Entity struct {
+	// CustomIdentifier identifies the host in the organization.
+	// If it is not empty, the record is posted as a host metric.
+	CustomIdentifier string
+
+	// Hostname is the name of the host.
+	// If it is empty, CustomIdentifier is used as the name.
+	Hostname string
+
+	// Service is the name of the service.
+	// If CustomIdentifier is empty, the record is posted as a service metric of Service.
+	Service string
+
+	// Role is the name of the role in Service that the host belongs to.
+	Role string
+
+	// Status is the status of the host; working, standby, maintenance or poweroff.
+	// If it is empty, the exporter don't change the status.
+	Status string
+}
+
+// RoleFullname returns a full qualified role name.
+func (ent *Entity) RoleFullname() string {
+	if ent.Service == "" || ent.Role == "" {
+		return ""
+	}
+	return ent.Service + ":" + ent.Role
+}
+
+// EntityMapper decides the entity of a record.
+// The labels contain both labels of the record and attributes of its resource.
+// If the mapper returns zero Entity, the record is not exported.
+// The labels are passed even if they don't form the resource;
+// in that case the host that the mapper decides is registered without host specs.
+type EntityMapper interface {
+	MapEntity(labels *label.Set) Entity
+}
+
+// EntityMapperFunc is an adapter to use ordinary functions as EntityMapper.
+type EntityMapperFunc func(labels *label.Set) Entity
+
+// MapEntity implements EntityMapper.
+func (f EntityMapperFunc) MapEntity(labels *label.Set) Entity {
+	return f(labels)
+}
+
+// DefaultEntityMapper returns the mapper that the exporter uses by default.
+// It decides entities from the semantic conventions of OpenTelemetry, and m.
+func DefaultEntityMapper(m ResourceMapping) EntityMapper {
+	return EntityMapperFunc(func(labels *label.Set) Entity {
+		var r tag.Resource
+		if err := tag.UnmarshalTags(labels.ToSlice(), &r); err != nil {
+			return Entity{}
+		}
+		m.apply(&r)
+		return defaultEntity(&r)
+	})
+}
+
+func defaultEntity(r *tag.Resource) Entity {
+	ent := Entity{
+		CustomIdentifier: r.CustomIdentifier(),
+		Service:          r.ServiceName(),
+		Role:             r.RoleName(),
+	}
+	if ent.CustomIdentifier != "" {
+		ent.Hostname = r.Hostname()
+		ent.Status = r.Host.Status
+	}
+	return ent
+}
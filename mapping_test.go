@@ -0,0 +1,208 @@
+package mackerel
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/label"
+
+	"github.com/mackerelio-labs/mackerelexporter-go/internal/tag"
+)
+
+func TestResourceMappingApply(t *testing.T) {
+	k8s := tag.K8S{
+		Cluster:    tag.Object{Name: "cluster"},
+		Pod:        tag.Object{UID: "pod-uid", Name: "pod"},
+		Deployment: tag.Object{Name: "web"},
+	}
+	container := tag.Container{ID: "container-id", Name: "app"}
+	tests := []struct {
+		m        ResourceMapping
+		id, name string
+		service  string
+		role     string
+	}{
+		{m: 0, id: "host-id", name: "host"},
+		{m: MapPodAsHost, id: "pod-uid", name: "pod"},
+		{m: MapContainerAsHost, id: "container-id", name: "app"},
+		{m: MapPodAsHost | MapContainerAsHost, id: "pod-uid", name: "pod"},
+		{m: MapDeploymentAsRole, id: "host-id", name: "host", service: "cluster", role: "web"},
+	}
+	for _, tt := range tests {
+		r := tag.Resource{
+			Host: tag.Host{
+				ID:     "host-id",
+				Name:   "host",
+				Arch:   "amd64",
+				Status: "working",
+				CPU:    tag.CPU{Count: 4},
+				Disk:   map[string]interface{}{"sda": map[string]interface{}{"size": "1024"}},
+			},
+			K8S:       k8s,
+			Container: container,
+		}
+		tt.m.apply(&r)
+		if r.Host.ID != tt.id || r.Host.Name != tt.name {
+			t.Errorf("%d: Host = %s(%s); want %s(%s)", tt.m, r.Host.Name, r.Host.ID, tt.name, tt.id)
+		}
+		if replaced := tt.id != "host-id"; replaced != (r.Host.CPU.Count == 0 && r.Host.Disk == nil && r.Host.Arch == "") {
+			t.Errorf("%d: Host specs = %+v; want dropped = %t", tt.m, r.Host, replaced)
+		}
+		if r.Host.Status != "working" {
+			t.Errorf("%d: Host.Status = %q; want working", tt.m, r.Host.Status)
+		}
+		if s := r.ServiceName(); s != tt.service {
+			t.Errorf("%d: ServiceName() = %q; want %q", tt.m, s, tt.service)
+		}
+		if s := r.RoleName(); s != tt.role {
+			t.Errorf("%d: RoleName() = %q; want %q", tt.m, s, tt.role)
+		}
+	}
+}
+
+func TestDefaultEntityMapper(t *testing.T) {
+	tests := []struct {
+		labels []label.KeyValue
+		want   Entity
+	}{
+		{
+			labels: []label.KeyValue{
+				KeyHostID.String("1-2-3-4"),
+				KeyHostName.String("host"),
+				KeyServiceNS.String("service"),
+				KeyServiceName.String("role"),
+			},
+			want: Entity{CustomIdentifier: "1-2-3-4", Hostname: "host", Service: "service", Role: "role"},
+		},
+		{
+			labels: []label.KeyValue{
+				KeyServiceNS.String("service"),
+				KeyServiceName.String("role"),
+				KeyServiceInstanceID.String("i-1"),
+			},
+			want: Entity{CustomIdentifier: "service/role/i-1", Hostname: "service-role-i-1", Service: "service", Role: "role"},
+		},
+		{
+			labels: []label.KeyValue{
+				KeyServiceNS.String("service"),
+			},
+			want: Entity{Service: "service"},
+		},
+		{
+			labels: []label.KeyValue{
+				KeyHostID.String("1-2-3-4"),
+				KeyHostName.String("host"),
+				label.Key("host.cpu").String("cpu0"),
+				label.Key("host.disk").String("sda"),
+			},
+			want: Entity{CustomIdentifier: "1-2-3-4", Hostname: "host"},
+		},
+	}
+	m := DefaultEntityMapper(0)
+	for _, tt := range tests {
+		set := label.NewSet(tt.labels...)
+		if ent := m.MapEntity(&set); ent != tt.want {
+			t.Errorf("MapEntity(%v) = %+v; want %+v", tt.labels, ent, tt.want)
+		}
+	}
+}
+
+func TestExportWithEntityMapper(t *testing.T) {
+	c := &brokenClient{}
+	m := EntityMapperFunc(func(labels *label.Set) Entity {
+		v, _ := labels.Value("team")
+		return Entity{Service: v.AsString()}
+	})
+	e := newTestExporter(t, c, WithEntityMapper(m))
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{
+			label.String("team", "payment"),
+			KeyHostID.String("1-2-3-4"),
+		}},
+	)
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.hostMetrics); n != 0 {
+		t.Errorf("len(hostMetrics) = %d; want 0", n)
+	}
+	if n := len(c.serviceMetrics["payment"]); n != 1 {
+		t.Errorf("len(serviceMetrics[payment]) = %d; want 1", n)
+	}
+}
+
+func TestExportMappingDropsCloudMeta(t *testing.T) {
+	ctx := context.Background()
+	labels := []label.KeyValue{
+		KeyHostID.String("i-1234"),
+		KeyHostName.String("ip-192-0-2-1"),
+		KeyCloudProvider.String("aws"),
+		KeyK8SPodUID.String("pod-uid"),
+		KeyK8SPodName.String("web-abc"),
+	}
+	tests := []struct {
+		m    ResourceMapping
+		id   string
+		want bool
+	}{
+		{m: 0, id: "i-1234", want: true},
+		{m: MapPodAsHost, id: "pod-uid", want: false},
+	}
+	for _, tt := range tests {
+		c := &handlerClient{}
+		e := newTestExporter(t, c, WithResourceMapping(tt.m))
+		cs := newCheckpointSet(t, testRecord{"requests", 1, labels})
+		if err := e.Export(ctx, cs); err != nil {
+			t.Fatalf("%d: Export() = %v", tt.m, err)
+		}
+		h, ok := e.hosts[tt.id]
+		if !ok {
+			t.Fatalf("%d: host %s is not registered", tt.m, tt.id)
+		}
+		if cloud := c.hosts[h.id].Meta.Cloud; (cloud != nil) != tt.want {
+			t.Errorf("%d: Cloud = %+v; want exists = %t", tt.m, cloud, tt.want)
+		}
+	}
+}
+
+func TestExportWithEntityMapperInvalidLabels(t *testing.T) {
+	c := &brokenClient{}
+	m := EntityMapperFunc(func(labels *label.Set) Entity {
+		v, _ := labels.Value("team")
+		return Entity{Service: v.AsString()}
+	})
+	e := newTestExporter(t, c, WithEntityMapper(m))
+	cs := newCheckpointSet(t,
+		testRecord{"requests", 1, []label.KeyValue{
+			label.String("team", "payment"),
+			label.String("service.name.suffix", "invalid"),
+		}},
+	)
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	if n := len(c.serviceMetrics["payment"]); n != 1 {
+		t.Errorf("len(serviceMetrics[payment]) = %d; want 1", n)
+	}
+}
+
+func TestExportServiceInstanceKeepsCloudMeta(t *testing.T) {
+	c := &handlerClient{}
+	e := newTestExporter(t, c)
+	cs := newCheckpointSet(t, testRecord{"requests", 1, []label.KeyValue{
+		KeyServiceNS.String("service"),
+		KeyServiceName.String("web"),
+		KeyServiceInstanceID.String("i-1"),
+		KeyCloudProvider.String("aws"),
+	}})
+	if err := e.Export(context.Background(), cs); err != nil {
+		t.Fatalf("Export() = %v", err)
+	}
+	h, ok := e.hosts["service/web/i-1"]
+	if !ok {
+		t.Fatal("host service/web/i-1 is not registered")
+	}
+	if cloud := c.hosts[h.id].Meta.Cloud; cloud == nil || cloud.Provider != cloudProviderEC2 {
+		t.Errorf("Cloud = %+v; want the provider %s", cloud, cloudProviderEC2)
+	}
+}
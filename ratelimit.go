@@ -0,0 +1,285 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	// throttleStep is the interval that is used first when the exporter is rate limited.
+	throttleStep = 100 * time.Millisecond
+
+	// maxThrottleInterval is the upper bound of the interval between requests.
+	maxThrottleInterval = 30 * time.Second
+)
+
+// ThrottleState represents the state of the client-side rate limiter.
+type ThrottleState struct {
+	// Throttled reports whether requests to Mackerel are delayed now.
+	Throttled bool
+
+	// Interval is the current minimum interval between requests.
+	Interval time.Duration
+
+	// RetryAfter is the time that Mackerel requested to wait until with Retry-After header.
+	RetryAfter time.Time
+
+	// RateLimited is the number of responses that are rejected by the rate limit so far.
+	RateLimited int64
+}
+
+// rateLimiter keeps the interval between requests.
+// The interval grows twice each time the request is rate limited,
+// and it shrinks gradually while requests are succeeded.
+type rateLimiter struct {
+	mu       sync.Mutex
+	min      time.Duration
+	interval time.Duration
+	next     time.Time
+	until    time.Time
+	count    int64
+}
+
+func newRateLimiter(min time.Duration) *rateLimiter {
+	return &rateLimiter{
+		min:      min,
+		interval: min,
+	}
+}
+
+// reserve returns the duration to wait before the next request.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.next
+	if t.Before(l.until) {
+		t = l.until
+	}
+	if t.Before(now) {
+		t = now
+	}
+	l.next = t.Add(l.interval)
+	return t.Sub(now)
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	d := l.reserve(time.Now())
+	if d <= 0 {
+		return ctx.Err()
+	}
+	return sleep(ctx, d)
+}
+
+// observe adjusts the interval with the result of the request.
+func (l *rateLimiter) observe(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		l.count++
+		l.interval *= 2
+		if l.interval < throttleStep {
+			l.interval = throttleStep
+		}
+		if l.interval > maxThrottleInterval {
+			l.interval = maxThrottleInterval
+		}
+	case err == nil:
+		l.interval -= l.interval / 4
+		if l.interval < throttleStep {
+			l.interval = 0
+		}
+		if l.interval < l.min {
+			l.interval = l.min
+		}
+	}
+}
+
+func (l *rateLimiter) retryAfter(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.until) {
+		l.until = t
+	}
+}
+
+func (l *rateLimiter) state(now time.Time) ThrottleState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ThrottleState{
+		Throttled:   l.interval > l.min || now.Before(l.until),
+		Interval:    l.interval,
+		RetryAfter:  l.until,
+		RateLimited: l.count,
+	}
+}
+
+// parseRetryAfter parses the value of Retry-After header.
+func parseRetryAfter(s string, now time.Time) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return now.Add(time.Duration(n) * time.Second), true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// retryAfterTransport tells Retry-After of rate limited responses to the limiter.
+type retryAfterTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if at, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			t.limiter.retryAfter(at)
+		}
+	}
+	return resp, nil
+}
+
+// limitedClient is a mackerelClient that is throttled by the limiter.
+type limitedClient struct {
+	c       mackerelClient
+	limiter *rateLimiter
+}
+
+var _ mackerelClient = &limitedClient{}
+
+func (c *limitedClient) do(ctx context.Context, f func() error) error {
+	if err := c.limiter.wait(ctx); err != nil {
+		return err
+	}
+	err := f()
+	c.limiter.observe(err)
+	return err
+}
+
+func (c *limitedClient) FindServices(ctx context.Context) (a []*mackerel.Service, err error) {
+	err = c.do(ctx, func() error {
+		a, err = c.c.FindServices(ctx)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) CreateService(ctx context.Context, param *mackerel.CreateServiceParam) (s *mackerel.Service, err error) {
+	err = c.do(ctx, func() error {
+		s, err = c.c.CreateService(ctx, param)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) FindRoles(ctx context.Context, serviceName string) (a []*mackerel.Role, err error) {
+	err = c.do(ctx, func() error {
+		a, err = c.c.FindRoles(ctx, serviceName)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) CreateRole(ctx context.Context, serviceName string, param *mackerel.CreateRoleParam) (r *mackerel.Role, err error) {
+	err = c.do(ctx, func() error {
+		r, err = c.c.CreateRole(ctx, serviceName, param)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) FindHosts(ctx context.Context, param *mackerel.FindHostsParam) (a []*mackerel.Host, err error) {
+	err = c.do(ctx, func() error {
+		a, err = c.c.FindHosts(ctx, param)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) CreateHost(ctx context.Context, param *mackerel.CreateHostParam) (id string, err error) {
+	err = c.do(ctx, func() error {
+		id, err = c.c.CreateHost(ctx, param)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) UpdateHost(ctx context.Context, hostID string, param *mackerel.UpdateHostParam) (id string, err error) {
+	err = c.do(ctx, func() error {
+		id, err = c.c.UpdateHost(ctx, hostID, param)
+		return err
+	})
+	return
+}
+
+func (c *limitedClient) RetireHost(ctx context.Context, hostID string) error {
+	return c.do(ctx, func() error {
+		return c.c.RetireHost(ctx, hostID)
+	})
+}
+
+func (c *limitedClient) UpdateHostStatus(ctx context.Context, hostID, status string) error {
+	return c.do(ctx, func() error {
+		return c.c.UpdateHostStatus(ctx, hostID, status)
+	})
+}
+
+func (c *limitedClient) UpdateHostRoleFullnames(ctx context.Context, hostID string, roleFullnames []string) error {
+	return c.do(ctx, func() error {
+		return c.c.UpdateHostRoleFullnames(ctx, hostID, roleFullnames)
+	})
+}
+
+func (c *limitedClient) PutServiceMetaData(ctx context.Context, serviceName, namespace string, v interface{}) error {
+	return c.do(ctx, func() error {
+		return c.c.PutServiceMetaData(ctx, serviceName, namespace, v)
+	})
+}
+
+func (c *limitedClient) PutRoleMetaData(ctx context.Context, serviceName, roleName, namespace string, v interface{}) error {
+	return c.do(ctx, func() error {
+		return c.c.PutRoleMetaData(ctx, serviceName, roleName, namespace, v)
+	})
+}
+
+func (c *limitedClient) PutHostMetaData(ctx context.Context, hostID, namespace string, v interface{}) error {
+	return c.do(ctx, func() error {
+		return c.c.PutHostMetaData(ctx, hostID, namespace, v)
+	})
+}
+
+func (c *limitedClient) CreateGraphDefs(ctx context.Context, defs []*mackerel.GraphDefsParam) error {
+	return c.do(ctx, func() error {
+		return c.c.CreateGraphDefs(ctx, defs)
+	})
+}
+
+func (c *limitedClient) PostHostMetricValues(ctx context.Context, metrics []*mackerel.HostMetricValue) error {
+	return c.do(ctx, func() error {
+		return c.c.PostHostMetricValues(ctx, metrics)
+	})
+}
+
+func (c *limitedClient) PostServiceMetricValues(ctx context.Context, name string, metrics []*mackerel.MetricValue) error {
+	return c.do(ctx, func() error {
+		return c.c.PostServiceMetricValues(ctx, name, metrics)
+	})
+}
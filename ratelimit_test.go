@@ -0,0 +1,87 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(0)
+	now := time.Now()
+	if d := l.reserve(now); d != 0 {
+		t.Errorf("reserve() = %v; want 0", d)
+	}
+
+	l.observe(&APIError{StatusCode: http.StatusTooManyRequests})
+	l.observe(&APIError{StatusCode: http.StatusTooManyRequests})
+	if s := l.state(now); !s.Throttled || s.Interval != 2*throttleStep || s.RateLimited != 2 {
+		t.Errorf("state() = %+v; want throttled with %v", s, 2*throttleStep)
+	}
+	l.reserve(now)
+	if d := l.reserve(now); d != 2*throttleStep {
+		t.Errorf("reserve() = %v; want %v", d, 2*throttleStep)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.observe(nil)
+	}
+	if s := l.state(now); s.Throttled || s.Interval != 0 {
+		t.Errorf("state() = %+v; want not throttled", s)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{s: "", ok: false},
+		{s: "10", want: now.Add(10 * time.Second), ok: true},
+		{s: "Thu, 01 Oct 2020 00:01:00 GMT", want: now.Add(time.Minute), ok: true},
+		{s: "soon", ok: false},
+	}
+	for _, tt := range tests {
+		v, ok := parseRetryAfter(tt.s, now)
+		if ok != tt.ok || !v.Equal(tt.want) {
+			t.Errorf("parseRetryAfter(%q) = %v, %t; want %v, %t", tt.s, v, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExporterThrottleState(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, `{"error":{"message":"too many requests"}}`, http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExporter(WithAPIKey("dummy"), WithBaseURL(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := e.ThrottleState(); s.Throttled {
+		t.Errorf("ThrottleState() = %+v; want not throttled", s)
+	}
+
+	t0 := time.Now()
+	if err := e.c.PostHostMetricValues(context.Background(), nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("PostHostMetricValues() = %v; want %v", err, ErrRateLimited)
+	}
+	s := e.ThrottleState()
+	if !s.Throttled || s.RateLimited != 1 {
+		t.Errorf("ThrottleState() = %+v; want throttled", s)
+	}
+	if d := s.RetryAfter.Sub(t0); d < 29*time.Second || d > 31*time.Second {
+		t.Errorf("RetryAfter = %v; want about 30 seconds later", s.RetryAfter)
+	}
+}
@@ -0,0 +1,305 @@
+package mackerel
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	defaultMaxRetries   = 2
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = 10 * time.Second
+	defaultMaxQueueSize = 60
+	defaultMaxQueueAge  = time.Hour
+
+	defaultMaxValuesPerRequest = 1000
+	defaultConcurrency         = 4
+)
+
+// batch is a set of metric values that is posted by one API request.
+// If Service is empty, the batch holds host metrics.
+type batch struct {
+	Service        string                      `json:"service,omitempty"`
+	HostMetrics    []*mackerel.HostMetricValue `json:"hostMetrics,omitempty"`
+	ServiceMetrics []*mackerel.MetricValue     `json:"serviceMetrics,omitempty"`
+	Created        time.Time                   `json:"created"`
+
+	// Chunk is 1-based index of the chunk if the batch is split. It is 0 if not.
+	Chunk  int `json:"chunk,omitempty"`
+	Chunks int `json:"chunks,omitempty"`
+}
+
+func (b *batch) len() int {
+	if b.Service == "" {
+		return len(b.HostMetrics)
+	}
+	return len(b.ServiceMetrics)
+}
+
+// split splits b into chunks that have n values at most.
+// It returns b itself if n <= 0 or b is small enough.
+func (b *batch) split(n int) []*batch {
+	size := b.len()
+	if n <= 0 || size <= n {
+		return []*batch{b}
+	}
+	chunks := (size + n - 1) / n
+	a := make([]*batch, 0, chunks)
+	for i := 0; i < size; i += n {
+		j := i + n
+		if j > size {
+			j = size
+		}
+		c := &batch{
+			Service: b.Service,
+			Created: b.Created,
+			Chunk:   len(a) + 1,
+			Chunks:  chunks,
+		}
+		if b.Service == "" {
+			c.HostMetrics = b.HostMetrics[i:j]
+		} else {
+			c.ServiceMetrics = b.ServiceMetrics[i:j]
+		}
+		a = append(a, c)
+	}
+	return a
+}
+
+func (b *batch) String() string {
+	if b.Service == "" {
+		return "host metrics"
+	}
+	return "service metrics"
+}
+
+// error returns the error that is occurred while posting b.
+func (b *batch) error(err error) *TargetError {
+	e := &TargetError{
+		Op:     OpPostHostMetrics,
+		Chunk:  b.Chunk,
+		Chunks: b.Chunks,
+		Err:    err,
+	}
+	if b.Service != "" {
+		e.Op = OpPostServiceMetrics
+		e.Service = b.Service
+	}
+	return e
+}
+
+// backoff calculates an exponential backoff with jitter.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+}
+
+// duration returns the duration to wait before n-th retry; n starts from 0.
+func (b *backoff) duration(n int) time.Duration {
+	d := b.min
+	for i := 0; i < n && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Equal jitter; the result is in [d/2, d).
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// resendQueue holds batches that could not be posted.
+// The oldest batch is dropped when the queue is full.
+type resendQueue struct {
+	size   int
+	maxAge time.Duration
+
+	mu sync.Mutex
+	a  []*batch
+}
+
+func (q *resendQueue) push(b *batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size <= 0 {
+		return
+	}
+	if len(q.a) >= q.size {
+		q.a = q.a[len(q.a)-q.size+1:]
+	}
+	q.a = append(q.a, b)
+}
+
+// pop returns the oldest batch that is not expired.
+func (q *resendQueue) pop(now time.Time) *batch {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.a) > 0 {
+		b := q.a[0]
+		q.a = q.a[1:]
+		if q.maxAge <= 0 || now.Sub(b.Created) <= q.maxAge {
+			return b
+		}
+	}
+	return nil
+}
+
+// unpop puts b back to the head of q.
+func (q *resendQueue) unpop(b *batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.a = append([]*batch{b}, q.a...)
+}
+
+func (e *Exporter) post(ctx context.Context, b *batch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if b.Service == "" {
+		return e.c.PostHostMetricValues(ctx, b.HostMetrics)
+	}
+	return e.c.PostServiceMetricValues(ctx, b.Service, b.ServiceMetrics)
+}
+
+// postWithRetry posts b. It retries up to MaxRetries times if the post failed temporarily.
+func (e *Exporter) postWithRetry(ctx context.Context, b *batch) error {
+	for i := 0; ; i++ {
+		err := e.post(ctx, b)
+		if err == nil {
+			return nil
+		}
+		if i >= e.opts.MaxRetries || !isTemporary(err) {
+			return err
+		}
+		if err := sleep(ctx, e.backoff.duration(i)); err != nil {
+			return err
+		}
+	}
+}
+
+// enqueue holds b to resend later.
+// If the spool is configured, b is written into the spool instead of the memory.
+func (e *Exporter) enqueue(b *batch) error {
+	if e.spool != nil {
+		if e.opts.MaxQueueSize <= 0 {
+			return nil
+		}
+		if err := e.spool.put(b); err != nil {
+			return err
+		}
+		return e.trimSpool(time.Now())
+	}
+	e.queue.push(b)
+	return nil
+}
+
+// resend posts queued batches, then spooled batches, in oldest-first order.
+// It stops at the first failure and keeps remaining batches in the queue.
+func (e *Exporter) resend(ctx context.Context) error {
+	if err := e.resendQueue(ctx); err != nil {
+		return err
+	}
+	if e.spool != nil {
+		return e.replay(ctx)
+	}
+	return nil
+}
+
+func (e *Exporter) resendQueue(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b := e.queue.pop(time.Now())
+		if b == nil {
+			return nil
+		}
+		if err := e.post(ctx, b); err != nil {
+			if !isTemporary(err) {
+				global.Handle(fmt.Errorf("drop queued %v: %w", b, err))
+				continue
+			}
+			e.queue.unpop(b)
+			return err
+		}
+	}
+}
+
+// send posts batches concurrently. The batches failed to post temporarily are queued to resend later.
+// When all of batches are posted, send resends queued batches.
+func (e *Exporter) send(ctx context.Context, batches []*batch) error {
+	results := e.postAll(ctx, batches)
+
+	var errs ExportError
+	for i, err := range results {
+		if err == nil {
+			continue
+		}
+		b := batches[i]
+		errs.add(b.error(err))
+		if !isTemporary(err) {
+			// Mackerel will reject b again.
+			continue
+		}
+		if err := e.enqueue(b); err != nil {
+			global.Handle(fmt.Errorf("can't hold %v to resend: %w", b, err))
+		}
+	}
+	if len(errs.Errors) > 0 {
+		return &errs
+	}
+	if err := e.resend(ctx); err != nil {
+		return &TargetError{Op: OpResendMetrics, Err: err}
+	}
+	return nil
+}
+
+// postAll posts batches with the worker pool that has Concurrency workers.
+// The i-th result is the error of batches[i].
+func (e *Exporter) postAll(ctx context.Context, batches []*batch) []error {
+	results := make([]error, len(batches))
+	n := e.opts.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	if n > len(batches) {
+		n = len(batches)
+	}
+	c := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range c {
+				results[i] = e.postWithRetry(ctx, batches[i])
+			}
+		}()
+	}
+	for i := range batches {
+		c <- i
+	}
+	close(c)
+	wg.Wait()
+	return results
+}
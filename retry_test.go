@@ -0,0 +1,184 @@
+package mackerel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// flakyClient fails to post metrics while fails is greater than 0.
+// Also it fails to post metrics that contain the value named bad.
+type flakyClient struct {
+	handlerClient
+	bad    string
+	fails  int
+	posted [][]*mackerel.HostMetricValue
+	mu     sync.Mutex
+}
+
+var errUnavailable = errors.New("service unavailable")
+
+func (c *flakyClient) PostHostMetricValues(ctx context.Context, metrics []*mackerel.HostMetricValue) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range metrics {
+		if m.Name == c.bad {
+			return errUnavailable
+		}
+	}
+	if c.fails > 0 {
+		c.fails--
+		return errUnavailable
+	}
+	c.posted = append(c.posted, metrics)
+	return nil
+}
+
+func newTestExporter(t *testing.T, c mackerelClient, opts ...Option) *Exporter {
+	t.Helper()
+	opts = append([]Option{WithRetryBackoff(time.Millisecond, time.Millisecond)}, opts...)
+	opts = append(opts, func(o *options) {
+		o.client = c
+	})
+	e, err := NewExporter(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.wg.Wait() // for the replay of the spool
+	return e
+}
+
+func hostBatch(name string, t time.Time) *batch {
+	return &batch{
+		HostMetrics: []*mackerel.HostMetricValue{
+			{
+				HostID:      "1",
+				MetricValue: &mackerel.MetricValue{Name: name, Value: 1, Time: t.Unix()},
+			},
+		},
+		Created: t,
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	b := backoff{min: time.Second, max: 10 * time.Second}
+	tests := []struct {
+		n        int
+		min, max time.Duration
+	}{
+		{n: 0, min: 500 * time.Millisecond, max: time.Second},
+		{n: 1, min: time.Second, max: 2 * time.Second},
+		{n: 3, min: 4 * time.Second, max: 8 * time.Second},
+		{n: 10, min: 5 * time.Second, max: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		d := b.duration(tt.n)
+		if d < tt.min || d > tt.max {
+			t.Errorf("duration(%d) = %v; want in [%v, %v]", tt.n, d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestResendQueue(t *testing.T) {
+	now := time.Now()
+	q := resendQueue{size: 2, maxAge: time.Hour}
+	q.push(hostBatch("custom.a", now.Add(-2*time.Hour)))
+	q.push(hostBatch("custom.b", now.Add(-time.Minute)))
+	q.push(hostBatch("custom.c", now))
+	if b := q.pop(now); b == nil || b.HostMetrics[0].Name != "custom.b" {
+		t.Errorf("pop() = %v; want custom.b", b)
+	}
+	if b := q.pop(now); b == nil || b.HostMetrics[0].Name != "custom.c" {
+		t.Errorf("pop() = %v; want custom.c", b)
+	}
+	if b := q.pop(now); b != nil {
+		t.Errorf("pop() = %v; want nil", b)
+	}
+
+	q.push(hostBatch("custom.d", now.Add(-2*time.Hour)))
+	if b := q.pop(now); b != nil {
+		t.Errorf("pop() = %v; want nil because it is expired", b)
+	}
+}
+
+func TestExporterSend(t *testing.T) {
+	ctx := context.Background()
+	c := &flakyClient{fails: 2}
+	e := newTestExporter(t, c, WithMaxRetries(1))
+
+	now := time.Now()
+	if err := e.send(ctx, []*batch{hostBatch("custom.a", now)}); !errors.Is(err, errUnavailable) {
+		t.Fatalf("send() = %v; want %v", err, errUnavailable)
+	}
+	if n := len(e.queue.a); n != 1 {
+		t.Fatalf("len(queue) = %d; want 1", n)
+	}
+	if err := e.send(ctx, []*batch{hostBatch("custom.b", now)}); err != nil {
+		t.Fatalf("send() = %v", err)
+	}
+	if n := len(e.queue.a); n != 0 {
+		t.Errorf("len(queue) = %d; want 0", n)
+	}
+	var names []string
+	for _, a := range c.posted {
+		names = append(names, a[0].Name)
+	}
+	if len(names) != 2 || names[0] != "custom.b" || names[1] != "custom.a" {
+		t.Errorf("posted = %v; want [custom.b custom.a]", names)
+	}
+}
+
+func TestBatchSplit(t *testing.T) {
+	b := &batch{Service: "service"}
+	for i := 0; i < 5; i++ {
+		b.ServiceMetrics = append(b.ServiceMetrics, &mackerel.MetricValue{Name: fmt.Sprintf("m%d", i)})
+	}
+	a := b.split(2)
+	if len(a) != 3 {
+		t.Fatalf("len(split(2)) = %d; want 3", len(a))
+	}
+	for i, c := range a {
+		if c.Service != "service" || c.Chunk != i+1 || c.Chunks != 3 {
+			t.Errorf("split(2)[%d] = %+v", i, c)
+		}
+	}
+	if n := len(a[2].ServiceMetrics); n != 1 {
+		t.Errorf("len(split(2)[2].ServiceMetrics) = %d; want 1", n)
+	}
+	if a := b.split(0); len(a) != 1 || a[0] != b {
+		t.Errorf("split(0) = %v; want the batch itself", a)
+	}
+}
+
+func TestExporterSendChunks(t *testing.T) {
+	c := &flakyClient{bad: "custom.m3"}
+	e := newTestExporter(t, c, WithMaxRetries(0))
+	e.opts.MaxValuesPerRequest = 2
+
+	b := &batch{Created: time.Now()}
+	for i := 0; i < 6; i++ {
+		b.HostMetrics = append(b.HostMetrics, &mackerel.HostMetricValue{
+			HostID:      "1",
+			MetricValue: &mackerel.MetricValue{Name: fmt.Sprintf("custom.m%d", i)},
+		})
+	}
+	err := e.send(context.Background(), b.split(e.opts.MaxValuesPerRequest))
+	var p *ExportError
+	if !errors.As(err, &p) || len(p.Errors) != 1 {
+		t.Fatalf("send() = %v; want an error", err)
+	}
+	if err := p.Errors[0]; err.Chunk != 2 || err.Chunks != 3 {
+		t.Errorf("Chunk = %d/%d; want 2/3", err.Chunk, err.Chunks)
+	}
+	if n := len(c.posted); n != 2 {
+		t.Errorf("len(posted) = %d; want 2", n)
+	}
+	if n := len(e.queue.a); n != 1 {
+		t.Errorf("len(queue) = %d; want 1", n)
+	}
+}
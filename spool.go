@@ -0,0 +1,247 @@
+package mackerel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+)
+
+const (
+	spoolFileExt    = ".json"
+	spoolBrokenExt  = ".broken"
+	spoolTempPrefix = "tmp-"
+
+	// Mackerel rejects metric values that are too old.
+	maxSpoolAge = 24 * time.Hour
+)
+
+// spool stores batches into files in dir.
+// The file name starts with the creation time, so that files are sorted by the time.
+type spool struct {
+	dir string
+
+	mu  sync.Mutex // guards seq
+	seq uint64
+
+	replayMu sync.Mutex // is held while replaying
+}
+
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir}, nil
+}
+
+func (s *spool) put(b *batch) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+	name := fmt.Sprintf("%020d-%06d%s", b.Created.UnixNano(), seq%1000000, spoolFileExt)
+	f, err := ioutil.TempFile(s.dir, spoolTempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+// files returns names of spooled files in oldest-first order.
+func (s *spool) files() ([]string, error) {
+	return s.list(spoolFileExt)
+}
+
+// brokenFiles returns names of discarded files in oldest-first order.
+func (s *spool) brokenFiles() ([]string, error) {
+	return s.list(spoolBrokenExt)
+}
+
+func (s *spool) list(ext string) ([]string, error) {
+	a, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range a {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, spoolTempPrefix) || filepath.Ext(name) != ext {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// created returns the creation time of the batch in the file name.
+func (s *spool) created(name string) (time.Time, bool) {
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+func (s *spool) load(name string) (*batch, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var b batch
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if b.Created.IsZero() || (b.HostMetrics == nil && b.ServiceMetrics == nil) {
+		return nil, fmt.Errorf("%s: invalid batch", name)
+	}
+	return &b, nil
+}
+
+func (s *spool) remove(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// discard renames the file name to not be loaded again.
+func (s *spool) discard(name string) error {
+	p := filepath.Join(s.dir, name)
+	return os.Rename(p, p+spoolBrokenExt)
+}
+
+// replay posts spooled batches in oldest-first order.
+// Corrupted, expired or rejected files are skipped, and they are reported to the global error handler.
+// It stops at the first failure of the post.
+func (e *Exporter) replay(ctx context.Context) error {
+	e.spool.replayMu.Lock()
+	defer e.spool.replayMu.Unlock()
+	names, err := e.spool.files()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := e.spool.load(name)
+		if os.IsNotExist(err) {
+			continue // trimmed meanwhile
+		}
+		if err != nil {
+			global.Handle(fmt.Errorf("skip the spooled file: %w", err))
+			if err := e.spool.discard(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if now.Sub(b.Created) > e.spoolAge() {
+			global.Handle(fmt.Errorf("drop the spooled file %s: expired", name))
+			if err := e.spool.remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.post(ctx, b); err != nil {
+			if !isTemporary(err) {
+				global.Handle(fmt.Errorf("skip the spooled file %s: %w", name, err))
+				if err := e.spool.discard(name); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+		if err := e.spool.remove(name); err != nil {
+			return err
+		}
+	}
+	return e.trimBrokenSpool()
+}
+
+// spoolAge returns the maximum age of spooled batches. MaxQueueAge is also applied to the spool.
+func (e *Exporter) spoolAge() time.Duration {
+	if d := e.opts.MaxQueueAge; d > 0 && d < maxSpoolAge {
+		return d
+	}
+	return maxSpoolAge
+}
+
+// trimSpool removes expired files, and the oldest files that exceed MaxQueueSize.
+// The removed files are reported to the global error handler.
+func (e *Exporter) trimSpool(now time.Time) error {
+	names, err := e.spool.files()
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		var reason string
+		if len(names)-i > e.opts.MaxQueueSize {
+			reason = "the spool is full"
+		} else if t, ok := e.spool.created(name); ok && now.Sub(t) > e.spoolAge() {
+			reason = "expired"
+		} else {
+			break
+		}
+		if err := e.spool.remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		global.Handle(fmt.Errorf("drop the spooled file %s: %s", name, reason))
+	}
+	return e.trimBrokenSpool()
+}
+
+// trimBrokenSpool removes the oldest discarded files that exceed MaxQueueSize.
+// They are kept to investigate, and they have been reported when they are discarded.
+func (e *Exporter) trimBrokenSpool() error {
+	names, err := e.spool.brokenFiles()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names)-e.opts.MaxQueueSize; i++ {
+		if err := e.spool.remove(names[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySpool resends spooled batches in background, without waiting for the next successful export.
+// Shutdown waits for it.
+func (e *Exporter) replaySpool() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ctx, cancel := e.abortContext(context.Background())
+		defer cancel()
+		if err := e.replay(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			global.Handle(fmt.Errorf("can't replay the spool: %w", err))
+		}
+	}()
+}
@@ -0,0 +1,227 @@
+package mackerel
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExporterReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &flakyClient{}
+	e := newTestExporter(t, c, WithSpoolDir(dir))
+	now := time.Now()
+	for _, b := range []*batch{
+		hostBatch("custom.expired", now.Add(-48*time.Hour)),
+		hostBatch("custom.b", now.Add(-time.Minute)),
+		hostBatch("custom.a", now.Add(-2*time.Minute)),
+	} {
+		if err := e.spool.put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broken := "00000000000000000001-000000.json"
+	if err := ioutil.WriteFile(filepath.Join(dir, broken), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.replay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range c.posted {
+		names = append(names, a[0].Name)
+	}
+	if len(names) != 2 || names[0] != "custom.a" || names[1] != "custom.b" {
+		t.Errorf("posted = %v; want [custom.a custom.b]", names)
+	}
+	files, err := e.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files = %v; want empty", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, broken+spoolBrokenExt)); err != nil {
+		t.Errorf("the broken file is not renamed: %v", err)
+	}
+}
+
+func TestExporterSendWithSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	c := &flakyClient{fails: 1}
+	e := newTestExporter(t, c, WithSpoolDir(dir), WithMaxRetries(0))
+	if err := e.send(ctx, []*batch{hostBatch("custom.a", time.Now())}); err == nil {
+		t.Fatal("send() = nil; want an error")
+	}
+	files, err := e.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files = %v; want 1 file", files)
+	}
+
+	// the spool is drained by another exporter, like after the restart.
+	e = newTestExporter(t, c, WithSpoolDir(dir))
+	if err := e.send(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.posted) != 1 || c.posted[0][0].Name != "custom.a" {
+		t.Errorf("posted = %v; want custom.a", c.posted)
+	}
+}
+
+func TestNewExporterReplaysSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, err := newSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.put(hostBatch("custom.a", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	// newTestExporter waits for the replay that is started by NewExporter.
+	c := &flakyClient{}
+	e := newTestExporter(t, c, WithSpoolDir(dir))
+	if len(c.posted) != 1 || c.posted[0][0].Name != "custom.a" {
+		t.Errorf("posted = %v; want custom.a", c.posted)
+	}
+	files, err := e.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files = %v; want empty", files)
+	}
+}
+
+func TestExporterEnqueueTrimsSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &flakyClient{}
+	e := newTestExporter(t, c, WithSpoolDir(dir), WithMaxQueueSize(2))
+	now := time.Now()
+	if err := e.spool.put(hostBatch("custom.expired", now.Add(-48*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*batch{
+		hostBatch("custom.a", now.Add(-3*time.Minute)),
+		hostBatch("custom.b", now.Add(-2*time.Minute)),
+		hostBatch("custom.c", now.Add(-time.Minute)),
+	} {
+		if err := e.enqueue(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := e.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, name := range files {
+		b, err := e.spool.load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, b.HostMetrics[0].Name)
+	}
+	if len(names) != 2 || names[0] != "custom.b" || names[1] != "custom.c" {
+		t.Errorf("spooled = %v; want [custom.b custom.c]", names)
+	}
+}
+
+func TestExporterSpoolMaxQueueAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &flakyClient{}
+	e := newTestExporter(t, c, WithSpoolDir(dir), WithMaxQueueAge(time.Hour))
+	now := time.Now()
+	if err := e.spool.put(hostBatch("custom.old", now.Add(-2*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.spool.put(hostBatch("custom.a", now.Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.replay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.posted) != 1 || c.posted[0][0].Name != "custom.a" {
+		t.Errorf("posted = %v; want custom.a", c.posted)
+	}
+
+	if err := e.spool.put(hostBatch("custom.old", now.Add(-2*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.enqueue(hostBatch("custom.b", now)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := e.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("files = %v; want only custom.b", files)
+	}
+}
+
+func TestExporterTrimBrokenSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &flakyClient{}
+	e := newTestExporter(t, c, WithSpoolDir(dir), WithMaxQueueSize(2))
+	names := []string{
+		"00000000000000000001-000000.json",
+		"00000000000000000002-000000.json",
+		"00000000000000000003-000000.json",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("{"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.replay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	broken, err := e.spool.brokenFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{names[1] + spoolBrokenExt, names[2] + spoolBrokenExt}
+	if !reflect.DeepEqual(broken, want) {
+		t.Errorf("broken files = %v; want %v", broken, want)
+	}
+}